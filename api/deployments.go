@@ -138,6 +138,9 @@ func deploymentServiceCreateHandler(c echo.Context) error {
 	}
 
 	waitGroup.Wait()
+	if failed {
+		return server.ErrorResponse(c, errors.InternalServerError())
+	}
 
 	deployment := &extv1beta1.Deployment{}
 	err = deploymentTemplate.Parse(deployment)
@@ -144,10 +144,18 @@ func New() *App {
 			switch config.GetString(config.DockerMode) {
 			case "registry":
 				err := repository.InitRegistry(&repository.RegistryConfig{
-					BaseURL:   config.GetString(config.RegistryURL),
-					Username:  config.GetString(config.RegistryUsername),
-					Password:  config.GetString(config.RegistryPassword),
-					Namespace: config.GetString(config.RegistryNamespace),
+					BaseURL:          config.GetString(config.RegistryURL),
+					Username:         config.GetString(config.RegistryUsername),
+					Password:         config.GetString(config.RegistryPassword),
+					Namespace:        config.GetString(config.RegistryNamespace),
+					PullDomain:       config.GetString(config.RegistryPullDomain),
+					BranchPrefixTags: config.GetBool(config.RegistryBranchInTags),
+					TimestampUnit:    repository.TimestampUnit(config.GetString(config.RegistryTimestampUnit)),
+					Flavor:           repository.RegistryFlavor(config.GetString(config.RegistryFlavor)),
+					UsePushTime:      config.GetBool(config.RegistryUsePushTime),
+					TokenFile:        config.GetString(config.RegistryTokenFile),
+					ClientCert:       config.GetString(config.RegistryClientCert),
+					ClientKey:        config.GetString(config.RegistryClientKey),
 				})
 				if err != nil {
 					log.Fatal(err)
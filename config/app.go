@@ -41,8 +41,16 @@ const (
 	RegistryURL             = "registry-url"
 	RegistryBranchDelimiter = "registry-branch-delimiter"
 	RegistryNamespace       = "registry-namespace"
+	RegistryPullDomain      = "registry-pull-domain"
 	RegistryUsername        = "registry-username"
 	RegistryPassword        = "registry-password"
+	RegistryBranchInTags    = "registry-branch-in-tags"
+	RegistryTimestampUnit   = "registry-timestamp-unit"
+	RegistryFlavor          = "registry-flavor"
+	RegistryUsePushTime     = "registry-use-push-time"
+	RegistryTokenFile       = "registry-token-file"
+	RegistryClientCert      = "registry-client-cert"
+	RegistryClientKey       = "registry-client-key"
 	BundleNamespace         = "bundle-namespace"
 	ECRAccountID            = "ecr-account-id"
 	FirebaseURL             = "firebase-url"
@@ -0,0 +1,319 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/transport"
+)
+
+// Warmup probes the registry and negotiates authorization for the given repositories
+// ahead of the first request for them, priming the cached challenges and tokens. It is
+// safe to call concurrently with other requests.
+func (s *RegistryService) Warmup(ctx context.Context, repos ...string) error {
+	if _, err := s.getChallengeManager(ctx); err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		_, transport, err := s.getRepositoryTransport(repo)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("GET", s.registryURL()+"/v2/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: transport}).Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if !client.SuccessStatus(resp.StatusCode) {
+			return client.HandleErrorResponse(resp)
+		}
+	}
+	return nil
+}
+
+// ValidateCredentials probes the registry and authorizes a request with the configured
+// credentials, negotiating a token if the registry requires one. It returns an error
+// wrapping ErrUnreachable if the registry cannot be connected to, ErrNotARegistry if the
+// URL does not serve the registry API, or ErrUnauthorized if the credentials are rejected.
+// Unlike other requests, it always probes the registry rather than using cached challenges.
+func (s *RegistryService) ValidateCredentials(ctx context.Context) error {
+	baseTransport := s.baseTransport()
+	req, err := http.NewRequest("GET", s.config.BaseURL+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: baseTransport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", s.config.BaseURL, ErrUnreachable, err)
+	}
+	resp.Body.Close()
+	if !isRegistryResponse(resp) {
+		return fmt.Errorf("%s: %w", s.config.BaseURL, ErrNotARegistry)
+	}
+	if client.SuccessStatus(resp.StatusCode) {
+		return nil
+	}
+
+	var modifier transport.RequestModifier
+	if s.config.TokenFile != "" {
+		tokenFile := &tokenFile{path: s.config.TokenFile}
+		if _, err := tokenFile.getToken(); err != nil {
+			return fmt.Errorf("failed to read registry token file: %w", err)
+		}
+		modifier = tokenFile
+	} else {
+		challengeManager := auth.NewSimpleChallengeManager()
+		if err := challengeManager.AddResponse(resp); err != nil {
+			return err
+		}
+		credentialStore := &basicCredentialStore{
+			Username: s.config.Username,
+			Password: s.config.Password,
+		}
+		modifier = auth.NewAuthorizer(
+			challengeManager,
+			auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+				Transport:   baseTransport,
+				Credentials: credentialStore,
+			}),
+			auth.NewBasicHandler(credentialStore),
+		)
+	}
+
+	req, err = http.NewRequest("GET", canonicalURL(s.config.BaseURL, resp)+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: transport.NewTransport(baseTransport, modifier)}
+	resp, err = httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		// token negotiation errors are returned by the transport, so only
+		// failures to connect are reported as unreachable
+		var netErr net.Error
+		if errors.As(errors.Unwrap(err), &netErr) {
+			return fmt.Errorf("%s: %w: %v", s.config.BaseURL, ErrUnreachable, err)
+		}
+		return fmt.Errorf("%s: %w: %v", s.config.BaseURL, ErrUnauthorized, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s: %w", s.config.BaseURL, ErrUnauthorized)
+	case !client.SuccessStatus(resp.StatusCode):
+		return client.HandleErrorResponse(resp)
+	}
+	return nil
+}
+
+// getChallengeManager returns the registry's auth challenges, probing /v2/ on first
+// use. Failed probes are not cached, so they are retried on the next request. If an
+// AuthCache is configured, the challenges are shared with other services for the same
+// registry and credentials.
+func (s *RegistryService) getChallengeManager(ctx context.Context) (auth.ChallengeManager, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.challengeManager != nil {
+		return s.challengeManager, nil
+	}
+
+	probe := s.probeChallenges
+	if s.config.AuthCache != nil {
+		probe = s.config.AuthCache.entry(s.config).probe(s.probeChallenges)
+	}
+	challengeManager, canonical, err := probe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.canonicalURL.Store(canonical)
+	s.challengeManager = challengeManager
+	return challengeManager, nil
+}
+
+// probeChallenges probes /v2/, returning the registry's auth challenges and canonical URL
+func (s *RegistryService) probeChallenges(ctx context.Context) (auth.ChallengeManager, string, error) {
+	req, err := http.NewRequest("GET", s.config.BaseURL+"/v2/", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := (&http.Client{Transport: s.baseTransport()}).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	resp.Body.Close()
+	if !isRegistryResponse(resp) {
+		return nil, "", fmt.Errorf("%s: %w", s.config.BaseURL, ErrNotARegistry)
+	}
+
+	challengeManager := auth.NewSimpleChallengeManager()
+	if err := challengeManager.AddResponse(resp); err != nil {
+		return nil, "", err
+	}
+	return challengeManager, canonicalURL(s.config.BaseURL, resp), nil
+}
+
+// AuthCache holds auth challenges and tokens shared by the services it is configured on.
+// Services for the same registry URL and credentials share a single /v2/ probe and the
+// tokens negotiated for each repository scope, so that many services for the same
+// registry don't each negotiate their own tokens. It is safe for concurrent use.
+type AuthCache struct {
+	mutex   sync.Mutex
+	entries map[authCacheKey]*authCacheEntry
+}
+
+// NewAuthCache returns an empty auth cache
+func NewAuthCache() *AuthCache {
+	return &AuthCache{entries: make(map[authCacheKey]*authCacheEntry)}
+}
+
+// authCacheKey identifies a registry and the credentials used to authorize with it.
+// Passwords are hashed so that the cache doesn't hold a copy of them.
+type authCacheKey struct {
+	baseURL      string
+	username     string
+	passwordHash [sha256.Size]byte
+	tokenFile    string
+}
+
+// authCacheEntry holds the challenges and request modifiers shared for a registry and
+// its credentials
+type authCacheEntry struct {
+	mutex            sync.Mutex
+	challengeManager auth.ChallengeManager
+	canonicalURL     string
+	modifiers        map[string]transport.RequestModifier
+}
+
+// entry returns the cache entry for the registry and credentials of the config
+func (c *AuthCache) entry(config *RegistryConfig) *authCacheEntry {
+	key := authCacheKey{
+		baseURL:      strings.TrimSuffix(config.BaseURL, "/"),
+		username:     config.Username,
+		passwordHash: sha256.Sum256([]byte(config.Password)),
+		tokenFile:    config.TokenFile,
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[authCacheKey]*authCacheEntry)
+	}
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &authCacheEntry{modifiers: make(map[string]transport.RequestModifier)}
+		c.entries[key] = entry
+	}
+	return entry
+}
+
+// probe wraps a probe of the registry so that it is only made once for the entry.
+// As for services, failed probes are not cached.
+func (e *authCacheEntry) probe(probe func(context.Context) (auth.ChallengeManager, string, error)) func(context.Context) (auth.ChallengeManager, string, error) {
+	return func(ctx context.Context) (auth.ChallengeManager, string, error) {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if e.challengeManager == nil {
+			challengeManager, canonical, err := probe(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			e.challengeManager, e.canonicalURL = challengeManager, canonical
+		}
+		return e.challengeManager, e.canonicalURL, nil
+	}
+}
+
+// modifier returns the shared request modifier for the scope, creating it if there is
+// none or if the shared one is stale, as when its token was rejected
+func (e *authCacheEntry) modifier(scope string, stale transport.RequestModifier, create func() transport.RequestModifier) transport.RequestModifier {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if modifier, ok := e.modifiers[scope]; ok && modifier != stale {
+		return modifier
+	}
+	modifier := create()
+	e.modifiers[scope] = modifier
+	return modifier
+}
+
+// registryURL returns the base URL of registry API requests. If the /v2/ probe was
+// redirected, as from http to https or to a canonical host, this is the URL it was
+// redirected to, so that requests are sent to the host the challenges were issued for.
+func (s *RegistryService) registryURL() string {
+	if canonical, ok := s.canonicalURL.Load().(string); ok {
+		return canonical
+	}
+	return s.config.BaseURL
+}
+
+// canonicalURL returns the base URL of the registry from the final response to the
+// /v2/ probe, after any redirects, or baseURL if the probe was not redirected
+func canonicalURL(baseURL string, resp *http.Response) string {
+	u := *resp.Request.URL
+	if !strings.HasSuffix(u.Path, "/v2/") {
+		return baseURL
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/v2/")
+	u.RawQuery = ""
+	if canonical := u.String(); canonical != strings.TrimSuffix(baseURL, "/") {
+		return canonical
+	}
+	return baseURL
+}
+
+// tokenFile is a request modifier that authorizes requests with the bearer token
+// held in a file. The token is cached until the file's modification time changes.
+type tokenFile struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	token   string
+}
+
+// ModifyRequest implements the transport.RequestModifier interface
+func (f *tokenFile) ModifyRequest(req *http.Request) error {
+	token, err := f.getToken()
+	if err != nil {
+		return fmt.Errorf("failed to read registry token file: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// getToken returns the current token, re-reading the file if it has changed
+func (f *tokenFile) getToken() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+	if f.token != "" && info.ModTime().Equal(f.modTime) {
+		return f.token, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", f.path)
+	}
+	f.token = token
+	f.modTime = info.ModTime()
+	return token, nil
+}
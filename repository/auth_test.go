@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWarmup(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:  server.URL,
+		Username: "user",
+		Password: "pass",
+	}}
+	assert.NoError(t, testService.Warmup(context.Background(), "vili"))
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			_, err := testService.GetTag("vili", "master")
+			assert.NoError(t, err)
+		}()
+	}
+	waitGroup.Wait()
+
+	probes := 0
+	for _, req := range reg.requests {
+		if req.URL.Path == "/v2/" && req.Header.Get("Authorization") == "" {
+			probes++
+		}
+	}
+	assert.Equal(t, 1, probes)
+}
+
+func TestRegistryCanonicalRedirect(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": testDigest("master")},
+	})
+	defer server.Close()
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	defer redirector.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: redirector.URL, Username: "user", Password: "pass"}}
+	dgst, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("master"), dgst)
+	assert.Equal(t, server.URL, testService.registryURL())
+	assert.NoError(t, testService.ValidateCredentials(context.Background()))
+}
+
+func TestRegistryValidateCredentials(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "user", Password: "pass"}}
+	assert.NoError(t, testService.ValidateCredentials(context.Background()))
+
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "user", Password: "wrong"}}
+	assert.True(t, errors.Is(testService.ValidateCredentials(context.Background()), ErrUnauthorized))
+
+	server.Close()
+	assert.True(t, errors.Is(testService.ValidateCredentials(context.Background()), ErrUnreachable))
+
+	notARegistry := httptest.NewServer(http.NotFoundHandler())
+	defer notARegistry.Close()
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: notARegistry.URL}}
+	assert.True(t, errors.Is(testService.ValidateCredentials(context.Background()), ErrNotARegistry))
+
+	var tokenServer *httptest.Server
+	tokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer tokenServer.Close()
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: tokenServer.URL, Username: "user", Password: "wrong"}}
+	assert.True(t, errors.Is(testService.ValidateCredentials(context.Background()), ErrUnauthorized))
+}
+
+func TestRegistryTokenFile(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "vili")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, TokenFile: path}}
+	_, err = testService.GetTag("vili", "master")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("first\n"), 0600))
+	reg.basicAuth = "Bearer first"
+	_, err = testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("second\n"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	reg.basicAuth = "Bearer second"
+	_, err = testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+}
+
+func TestRegistryReauthorizeOnUnauthorized(t *testing.T) {
+	var mutex sync.Mutex
+	var tokens, valid int
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/token" {
+			tokens++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token": "token-%d", "expires_in": 300}`, tokens)
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", valid) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:vili:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeSchema2)
+		w.Header().Set("Docker-Content-Digest", testDigest("vili"))
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "user", Password: "pass"}}
+	valid = 1
+	_, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+
+	// the token is revoked before it expires
+	mutex.Lock()
+	valid = 2
+	mutex.Unlock()
+	_, err = testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tokens)
+
+	mutex.Lock()
+	valid = 0
+	mutex.Unlock()
+	_, err = testService.GetTag("vili", "master")
+	assert.Error(t, err)
+	assert.Equal(t, 3, tokens)
+}
+
+func TestRegistryAuthCache(t *testing.T) {
+	var mutex sync.Mutex
+	var probes, tokens int
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/token" {
+			tokens++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token": "token-%s", "expires_in": 300}`, r.URL.Query().Get("account"))
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if r.URL.Path == "/v2/" && r.Header.Get("Authorization") == "" {
+			probes++
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer token-") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeSchema2)
+		w.Header().Set("Docker-Content-Digest", testDigest("vili"))
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer server.Close()
+
+	cache := NewAuthCache()
+	for i := 0; i < 3; i++ {
+		testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "user", Password: "pass", AuthCache: cache}}
+		_, err := testService.GetTag("vili", "master")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, probes)
+	assert.Equal(t, 1, tokens)
+
+	// other credentials negotiate their own token
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "other", Password: "pass", AuthCache: cache}}
+	_, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, probes)
+	assert.Equal(t, 2, tokens)
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/client"
+)
+
+// BlobExists returns whether the blob with the given digest exists in the repository
+func (s *RegistryService) BlobExists(repo, blobDigest string) (bool, error) {
+	return s.BlobExistsContext(context.Background(), repo, blobDigest)
+}
+
+// BlobExistsContext returns whether the blob exists like BlobExists, cancelling the
+// request when the context is done
+func (s *RegistryService) BlobExistsContext(ctx context.Context, repo, blobDigest string) (bool, error) {
+	dgst, err := parseDigest(blobDigest)
+	if err != nil {
+		return false, err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return false, err
+	}
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), &contextTransport{base: transport, ctx: ctx})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = repository.Blobs(ctx).Stat(ctx, dgst)
+	switch err {
+	case nil:
+		return true, nil
+	case distribution.ErrBlobUnknown:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// GetBlob streams the content of the blob with the given digest in the repository,
+// returning it with the blob's size. The caller must close the returned reader.
+func (s *RegistryService) GetBlob(repo, blobDigest string) (io.ReadCloser, int64, error) {
+	return s.GetBlobContext(context.Background(), repo, blobDigest)
+}
+
+// GetBlobContext streams the content of a blob like GetBlob, cancelling the download
+// when the context is done. If VerifyBlobs is set, reading the end of the content
+// fails if it does not match the digest.
+func (s *RegistryService) GetBlobContext(ctx context.Context, repo, blobDigest string) (io.ReadCloser, int64, error) {
+	dgst, err := parseDigest(blobDigest)
+	if err != nil {
+		return nil, 0, err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, 0, err
+	}
+	transport = s.limitTransfer(&contextTransport{base: transport, ctx: ctx})
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blobs := repository.Blobs(ctx)
+	desc, err := blobs.Stat(ctx, dgst)
+	if err == distribution.ErrBlobUnknown {
+		return nil, 0, &NotFoundError{}
+	} else if err != nil {
+		return nil, 0, err
+	}
+	reader, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !s.config.VerifyBlobs {
+		return reader, desc.Size, nil
+	}
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+	return &verifyingReadCloser{
+		ReadCloser: reader,
+		reader:     io.TeeReader(reader, verifier),
+		verifier:   verifier,
+		digest:     dgst,
+	}, desc.Size, nil
+}
+
+// verifyingReadCloser verifies the content read against its digest at the end of the content
+type verifyingReadCloser struct {
+	io.ReadCloser
+	reader   io.Reader
+	verifier digest.Verifier
+	digest   digest.Digest
+}
+
+// Read implements the io.Reader interface
+func (r *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, fmt.Errorf("blob content does not match its digest %s", r.digest)
+	}
+	return n, err
+}
+
+// SharedBlobs returns the blobs referenced by the given tag's manifest, mapped to the other
+// tags in the repository whose manifests also reference them. Blobs that are only
+// referenced by the given tag map to an empty slice, and are safe to garbage collect
+// along with the tag.
+func (s *RegistryService) SharedBlobs(repo, tag string) (map[string][]string, error) {
+	return s.SharedBlobsContext(context.Background(), repo, tag)
+}
+
+// SharedBlobsContext returns the blobs shared with other tags like SharedBlobs,
+// cancelling the requests when the context is done
+func (s *RegistryService) SharedBlobsContext(ctx context.Context, repo, tag string) (map[string][]string, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	transport = s.limitTransfer(&contextTransport{base: transport, ctx: ctx})
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	tagBlobs, err := s.getManifestBlobs(httpClient, repoNameRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	sharedBlobs := make(map[string][]string, len(tagBlobs))
+	for _, blob := range tagBlobs {
+		sharedBlobs[blob] = []string{}
+	}
+
+	tags, err := listTags(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	lim := newLimiter(s.manifestConcurrency())
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	errChan := make(chan error, len(tags))
+	for _, otherTag := range tags {
+		if otherTag == tag {
+			continue
+		}
+		waitGroup.Add(1)
+		go func(otherTag string) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			blobs, err := s.getManifestBlobs(httpClient, repoNameRef, otherTag)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			seen := make(map[string]bool, len(blobs))
+			for _, blob := range blobs {
+				if tags, ok := sharedBlobs[blob]; ok && !seen[blob] {
+					sharedBlobs[blob] = append(tags, otherTag)
+					seen[blob] = true
+				}
+			}
+		}(otherTag)
+	}
+	waitGroup.Wait()
+	close(errChan)
+
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	for _, tags := range sharedBlobs {
+		sort.Strings(tags)
+	}
+	return sharedBlobs, nil
+}
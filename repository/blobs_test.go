@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryBlobExists(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{"vili": {}})
+	existing, missing := digest.FromBytes([]byte("a")).String(), digest.FromBytes([]byte("b")).String()
+	reg.blobs = map[string]bool{existing: true}
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	exists, err := testService.BlobExists("vili", existing)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = testService.BlobExists("vili", missing)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = testService.BlobExists("vili", "not-a-digest")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = testService.BlobExistsContext(ctx, "vili", existing)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
+
+func TestRegistryGetBlob(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{"vili": {}})
+	defer server.Close()
+	blob, corrupt := digest.FromBytes([]byte("sbom")).String(), digest.FromBytes([]byte("sig!")).String()
+	reg.blobs = map[string]bool{blob: true, corrupt: true}
+	reg.blobContents = map[string]string{blob: "sbom", corrupt: "fake"}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, VerifyBlobs: true}}
+	reader, size, err := testService.GetBlob("vili", blob)
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "sbom", string(content))
+		assert.Equal(t, int64(4), size)
+		reader.Close()
+	}
+
+	reader, _, err = testService.GetBlob("vili", corrupt)
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(reader)
+		assert.Error(t, err)
+		reader.Close()
+	}
+
+	_, _, err = testService.GetBlob("vili", digest.FromBytes([]byte("missing")).String())
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestRegistrySharedBlobs(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"a": testDigest("a"), "b": testDigest("b"), "c": testDigest("c")},
+	})
+	reg.manifests = map[string]string{
+		"a":             `{"schemaVersion":2,"mediaType":"` + MediaTypeSchema2 + `","config":{"digest":"` + testDigest("config-a") + `"},"layers":[{"digest":"` + testDigest("base") + `"},{"digest":"` + testDigest("app-a") + `"}]}`,
+		"b":             `{"schemaVersion":2,"mediaType":"` + MediaTypeSchema2 + `","config":{"digest":"` + testDigest("config-b") + `"},"layers":[{"digest":"` + testDigest("base") + `"},{"digest":"` + testDigest("app-b") + `"}]}`,
+		"c":             `{"schemaVersion":2,"mediaType":"` + MediaTypeManifestList + `","manifests":[{"digest":"` + testDigest("a") + `"}]}`,
+		testDigest("a"): `{"schemaVersion":2,"mediaType":"` + MediaTypeSchema2 + `","config":{"digest":"` + testDigest("config-a") + `"},"layers":[{"digest":"` + testDigest("base") + `"},{"digest":"` + testDigest("app-a") + `"}]}`,
+	}
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	sharedBlobs, err := testService.SharedBlobs("vili", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		testDigest("config-b"): {},
+		testDigest("base"):     {"a", "c"},
+		testDigest("app-b"):    {},
+	}, sharedBlobs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = testService.SharedBlobsContext(ctx, "vili", "b")
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
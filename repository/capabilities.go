@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// Capabilities are the features supported by the registry
+type Capabilities struct {
+	// MediaTypes are the accepted manifest media types that the registry serves,
+	// in order of preference
+	MediaTypes []string
+}
+
+// Capabilities probes the manifest media types supported by the registry, by requesting
+// the given tag's manifest with each accepted media type in turn. A media type that the
+// registry rejects as not acceptable for a manifest of the same kind, image or manifest
+// list, is left out of the Accept headers of later manifest requests until a probe is
+// served it again. An image rejected as a manifest list says nothing about the
+// registry, so it isn't left out. If a probe fails, its error is returned and the
+// results of previous probes are kept.
+func (s *RegistryService) Capabilities(repo, tag string) (*Capabilities, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	mediaTypes := s.allAcceptedMediaTypes()
+	_, actualType, err := s.probeManifest(httpClient, repoNameRef, tag, mediaTypes...)
+	if err != nil {
+		return nil, err
+	}
+
+	supported := make(map[string]bool)
+	unsupported := make(map[string]bool)
+	for _, mediaType := range mediaTypes {
+		status, _, err := s.probeManifest(httpClient, repoNameRef, tag, mediaType)
+		switch {
+		case err == nil:
+			supported[mediaType] = true
+		case (status == http.StatusNotAcceptable || status == http.StatusNotFound) &&
+			isIndexMediaType(mediaType) != isIndexMediaType(actualType):
+			// the manifest is not of this kind, which says nothing about the registry
+		case status == http.StatusNotAcceptable:
+			unsupported[mediaType] = true
+		default:
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	merged := make(map[string]bool, len(s.unsupportedMediaTypes)+len(unsupported))
+	for mediaType := range s.unsupportedMediaTypes {
+		if !supported[mediaType] {
+			merged[mediaType] = true
+		}
+	}
+	for mediaType := range unsupported {
+		merged[mediaType] = true
+	}
+	s.unsupportedMediaTypes = merged
+	s.mutex.Unlock()
+	return &Capabilities{MediaTypes: s.acceptedMediaTypes()}, nil
+}
+
+// probeManifest issues a HEAD request for the manifest accepting only the given media
+// types, returning the response's status and media type. Responses that are not
+// successful are returned as an error along with their status.
+func (s *RegistryService) probeManifest(httpClient *http.Client, name reference.Named, ref string, mediaTypes ...string) (int, string, error) {
+	req, err := http.NewRequest("HEAD", s.registryURL()+"/v2/"+name.Name()+"/manifests/"+ref, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, mediaType := range mediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return resp.StatusCode, "", client.HandleErrorResponse(resp)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return resp.StatusCode, mediaType, nil
+}
+
+// isIndexMediaType returns whether the media type is that of a manifest list or index
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == MediaTypeManifestList || mediaType == MediaTypeOCIIndex
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryCapabilities(t *testing.T) {
+	var mutex sync.Mutex
+	var accepted [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+			return
+		}
+		mutex.Lock()
+		accepted = append(accepted, r.Header["Accept"])
+		mutex.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, mediaType := range r.Header["Accept"] {
+			if !strings.HasPrefix(mediaType, "application/vnd.oci.") {
+				w.Header().Set("Content-Type", MediaTypeSchema2)
+				w.Header().Set("Docker-Content-Digest", testDigest("vili"))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotAcceptable)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	capabilities, err := testService.Capabilities("vili", "master")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the OCI index is rejected because master is an image, not because the registry
+	// doesn't serve OCI indexes
+	assert.Equal(t, []string{MediaTypeOCIIndex, MediaTypeManifestList, MediaTypeSchema2}, capabilities.MediaTypes)
+	assert.Len(t, accepted, len(manifestMediaTypes)+1)
+
+	accepted = nil
+	exists, err := testService.Exists("vili", "master")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, [][]string{{MediaTypeOCIIndex, MediaTypeManifestList, MediaTypeSchema2}}, accepted)
+
+	// failed probes keep the previous results
+	_, err = testService.Capabilities("vili", "missing")
+	assert.Error(t, err)
+	assert.Equal(t, []string{MediaTypeOCIIndex, MediaTypeManifestList, MediaTypeSchema2}, testService.acceptedMediaTypes())
+}
@@ -0,0 +1,183 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Cassette is a recording of the calls made to a Service and their results, in the
+// order they were made
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded Service call and its result
+type Interaction struct {
+	Method   string   `json:"method"`
+	Repo     string   `json:"repo"`
+	Branches []string `json:"branches,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+
+	Images []*Image `json:"images,omitempty"`
+	Result string   `json:"result,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// key identifies the call of the interaction, regardless of its result
+func (i *Interaction) key() string {
+	return strings.Join([]string{i.Method, i.Repo, strings.Join(i.Branches, ","), i.Tag}, "\x00")
+}
+
+// err returns the recorded error of the interaction, if any
+func (i *Interaction) err() error {
+	if i.Error == "" {
+		return nil
+	}
+	return errors.New(i.Error)
+}
+
+// ReadCassette reads a cassette written by RecordingService.WriteCassette
+func ReadCassette(r io.Reader) (*Cassette, error) {
+	cassette := &Cassette{}
+	if err := json.NewDecoder(r).Decode(cassette); err != nil {
+		return nil, err
+	}
+	return cassette, nil
+}
+
+// RecordingService is an implementation of the docker Service interface
+// It wraps another Service and records each call and its result to a Cassette
+type RecordingService struct {
+	service DockerService
+
+	mutex    sync.Mutex
+	cassette Cassette
+}
+
+// NewRecordingService returns a service that records the calls made to the given service
+func NewRecordingService(service DockerService) *RecordingService {
+	return &RecordingService{service: service}
+}
+
+// GetRepository implements the Service interface
+func (s *RecordingService) GetRepository(repo string, branches []string) ([]*Image, error) {
+	images, err := s.service.GetRepository(repo, branches)
+	s.record(&Interaction{Method: "GetRepository", Repo: repo, Branches: branches, Images: images}, err)
+	return images, err
+}
+
+// GetTag implements the Service interface
+func (s *RecordingService) GetTag(repo, tag string) (string, error) {
+	digest, err := s.service.GetTag(repo, tag)
+	s.record(&Interaction{Method: "GetTag", Repo: repo, Tag: tag, Result: digest}, err)
+	return digest, err
+}
+
+// FullName implements the Service interface
+func (s *RecordingService) FullName(repo, tag string) (string, error) {
+	fullName, err := s.service.FullName(repo, tag)
+	s.record(&Interaction{Method: "FullName", Repo: repo, Tag: tag, Result: fullName}, err)
+	return fullName, err
+}
+
+// record appends the interaction to the cassette
+func (s *RecordingService) record(interaction *Interaction, err error) {
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cassette.Interactions = append(s.cassette.Interactions, interaction)
+}
+
+// Cassette returns the calls recorded so far
+func (s *RecordingService) Cassette() *Cassette {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &Cassette{Interactions: append([]*Interaction(nil), s.cassette.Interactions...)}
+}
+
+// WriteCassette writes the calls recorded so far as indented JSON
+func (s *RecordingService) WriteCassette(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s.Cassette())
+}
+
+// UnexpectedCallError is raised when a ReplayingService is called with arguments that
+// were not recorded, or more times than they were recorded
+type UnexpectedCallError struct {
+	Method string
+	Repo   string
+	Tag    string
+}
+
+func (e *UnexpectedCallError) Error() string {
+	if e.Tag != "" {
+		return fmt.Sprintf("Unexpected call %s(%s, %s) not in cassette", e.Method, e.Repo, e.Tag)
+	}
+	return fmt.Sprintf("Unexpected call %s(%s) not in cassette", e.Method, e.Repo)
+}
+
+// ReplayingService is an implementation of the docker Service interface
+// It answers calls from a Cassette. Calls made with the same arguments more than once
+// are answered in the order they were recorded. Recorded errors are replayed with
+// their messages only.
+type ReplayingService struct {
+	mutex        sync.Mutex
+	interactions map[string][]*Interaction
+}
+
+// NewReplayingService returns a service answering calls from the cassette
+func NewReplayingService(cassette *Cassette) *ReplayingService {
+	s := &ReplayingService{interactions: make(map[string][]*Interaction)}
+	for _, interaction := range cassette.Interactions {
+		key := interaction.key()
+		s.interactions[key] = append(s.interactions[key], interaction)
+	}
+	return s
+}
+
+// GetRepository implements the Service interface
+func (s *ReplayingService) GetRepository(repo string, branches []string) ([]*Image, error) {
+	interaction, err := s.replay(&Interaction{Method: "GetRepository", Repo: repo, Branches: branches})
+	if err != nil {
+		return nil, err
+	}
+	return interaction.Images, interaction.err()
+}
+
+// GetTag implements the Service interface
+func (s *ReplayingService) GetTag(repo, tag string) (string, error) {
+	interaction, err := s.replay(&Interaction{Method: "GetTag", Repo: repo, Tag: tag})
+	if err != nil {
+		return "", err
+	}
+	return interaction.Result, interaction.err()
+}
+
+// FullName implements the Service interface
+func (s *ReplayingService) FullName(repo, tag string) (string, error) {
+	interaction, err := s.replay(&Interaction{Method: "FullName", Repo: repo, Tag: tag})
+	if err != nil {
+		return "", err
+	}
+	return interaction.Result, interaction.err()
+}
+
+// replay returns the next recorded interaction for the call
+func (s *ReplayingService) replay(call *Interaction) (*Interaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := call.key()
+	recorded := s.interactions[key]
+	if len(recorded) == 0 {
+		return nil, &UnexpectedCallError{Method: call.Method, Repo: call.Repo, Tag: call.Tag}
+	}
+	s.interactions[key] = recorded[1:]
+	return recorded[0], nil
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingService(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	recorder := NewRecordingService(&RegistryService{config: &RegistryConfig{BaseURL: server.URL}})
+	images, err := recorder.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	digest, err := recorder.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	_, missingErr := recorder.GetTag("vili", "missing")
+	assert.Error(t, missingErr)
+	fullName, err := recorder.FullName("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, recorder.WriteCassette(&buf))
+	cassette, err := ReadCassette(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, cassette.Interactions, 4)
+
+	player := NewReplayingService(cassette)
+	replayedImages, err := player.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, replayedImages, 1) {
+		assert.Equal(t, images[0].Tag, replayedImages[0].Tag)
+		assert.True(t, images[0].LastModified.Equal(replayedImages[0].LastModified))
+	}
+	replayedDigest, err := player.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, replayedDigest)
+	_, err = player.GetTag("vili", "missing")
+	assert.EqualError(t, err, missingErr.Error())
+	replayedFullName, err := player.FullName("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, fullName, replayedFullName)
+
+	_, err = player.GetTag("vili", "1500000000-abcdef")
+	assert.IsType(t, &UnexpectedCallError{}, err)
+	_, err = player.GetRepository("redis", nil)
+	assert.IsType(t, &UnexpectedCallError{}, err)
+}
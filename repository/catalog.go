@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/registry/client"
+)
+
+// catalogPageSize is the number of repositories requested per catalog page
+const catalogPageSize = 100
+
+// catalogScope is the token scope authorizing catalog requests
+type catalogScope struct{}
+
+// String implements the distribution auth.Scope interface
+func (catalogScope) String() string {
+	return "registry:catalog:*"
+}
+
+// ListSubRepositories returns the sorted names of the repositories directly beneath
+// the prefix, grouping deeper repositories by their first path component, so that
+// team/payments/api and team/payments/web/v2 are listed as api and web for the prefix
+// team/payments. Like repository names, the prefix is relative to the Namespace unless
+// it starts with a slash. The registry must serve the catalog API.
+func (s *RegistryService) ListSubRepositories(prefix string) ([]string, error) {
+	base := s.config.Namespace
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		var err error
+		if base, err = s.repositoryPath(prefix); err != nil {
+			return nil, err
+		}
+	}
+	if base != "" {
+		base += "/"
+	}
+
+	repositories, err := s.listCatalog()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var children []string
+	for _, repository := range repositories {
+		if !strings.HasPrefix(repository, base) {
+			continue
+		}
+		child := strings.TrimPrefix(repository, base)
+		if sepIndex := strings.Index(child, "/"); sepIndex != -1 {
+			child = child[:sepIndex]
+		}
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// listCatalog lists every repository in the registry's catalog, following pagination
+func (s *RegistryService) listCatalog() ([]string, error) {
+	transport, err := s.getAuthorizedTransport(catalogScope{})
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	var repositories []string
+	u := fmt.Sprintf("%s/v2/_catalog?n=%d", s.registryURL(), catalogPageSize)
+	for u != "" {
+		resp, err := httpClient.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		if !client.SuccessStatus(resp.StatusCode) {
+			err := client.HandleErrorResponse(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var catalog struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&catalog)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, catalog.Repositories...)
+
+		u = ""
+		if link := nextLink(resp.Header.Get("Link")); link != "" {
+			next, err := resp.Request.URL.Parse(link)
+			if err != nil {
+				return nil, err
+			}
+			u = next.String()
+		}
+	}
+	return repositories, nil
+}
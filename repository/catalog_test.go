@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryListSubRepositories(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"team/payments":        {},
+		"team/payments/api":    {},
+		"team/payments/web":    {},
+		"team/payments/web/v2": {},
+		"team/search":          {},
+		"other/payments/api":   {},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	children, err := testService.ListSubRepositories("team/payments")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api", "web"}, children)
+
+	children, err = testService.ListSubRepositories("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other", "team"}, children)
+
+	testService.config.Namespace = "team"
+	children, err = testService.ListSubRepositories("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments", "search"}, children)
+	children, err = testService.ListSubRepositories("/other")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments"}, children)
+}
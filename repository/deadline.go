@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// branchDeadlines allocates each branch fetch a fair slice of an overall deadline
+type branchDeadlines struct {
+	ctx         context.Context
+	concurrency int
+	slice       time.Duration
+}
+
+// divide divides the time left until the context's deadline among the branches.
+// Branches are fetched concurrency at a time, so each branch gets the time left
+// divided by the number of rounds of fetches.
+func (d *branchDeadlines) divide(branches int) {
+	deadline, ok := d.ctx.Deadline()
+	if !ok || branches == 0 {
+		return
+	}
+	rounds := 1
+	if d.concurrency > 0 {
+		rounds = (branches + d.concurrency - 1) / d.concurrency
+	}
+	d.slice = time.Until(deadline) / time.Duration(rounds)
+}
+
+// begin starts the slice of a branch fetch, returning a function that wraps the
+// fetch's transport to cancel its requests when the slice is over, and a function
+// that releases the slice once the fetch is done. A nil branchDeadlines imposes no
+// deadline.
+func (d *branchDeadlines) begin() (func(http.RoundTripper) http.RoundTripper, func()) {
+	if d == nil {
+		return func(transport http.RoundTripper) http.RoundTripper { return transport }, func() {}
+	}
+	ctx, cancel := d.ctx, context.CancelFunc(func() {})
+	if d.slice > 0 {
+		ctx, cancel = context.WithTimeout(d.ctx, d.slice)
+	}
+	return func(transport http.RoundTripper) http.RoundTripper {
+		return &contextTransport{base: transport, ctx: ctx}
+	}, cancel
+}
+
+// contextTransport is an http.RoundTripper that cancels its requests when a context
+// is done, as well as when their own context is
+type contextTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+// RoundTrip implements the http.RoundTripper interface. The request is made with a
+// context keeping the values of its own, cancelled by either context, and released
+// once the response body is closed.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	if deadline, ok := t.ctx.Deadline(); ok {
+		ctx, cancel = withDeadline(ctx, cancel, deadline)
+	}
+	stop := context.AfterFunc(t.ctx, func() {
+		// a deadline is left to expire in the derived context, so that it is reported
+		if !errors.Is(t.ctx.Err(), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+	release := func() {
+		stop()
+		cancel()
+	}
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// withDeadline derives a context from ctx with the deadline, returning a function that
+// cancels both
+func withDeadline(ctx context.Context, cancel context.CancelFunc, deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx, cancelDeadline := context.WithDeadline(ctx, deadline)
+	return ctx, func() {
+		cancelDeadline()
+		cancel()
+	}
+}
+
+// releasingReadCloser is an io.ReadCloser that calls release once it is closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+// Close implements the io.Closer interface
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// GetRepositoryWithDeadline fetches the images for the given branches like GetRepository,
+// dividing the time left until the context's deadline fairly among the branches, so
+// that a slow branch can't use up the time of the others. Branches that run out of
+// their slice are cancelled, and the images of the other branches are returned with a
+// BranchesError holding the timed out branches.
+func (s *RegistryService) GetRepositoryWithDeadline(ctx context.Context, repo string, branches []string) ([]*Image, error) {
+	concurrency := s.config.MaxConcurrency
+	if s.config.BranchConcurrency > 0 && (concurrency <= 0 || s.config.BranchConcurrency < concurrency) {
+		concurrency = s.config.BranchConcurrency
+	}
+	if s.config.Sequential {
+		concurrency = 1
+	}
+	deadlines := &branchDeadlines{ctx: ctx, concurrency: concurrency}
+	result, err := s.getRepositoryResult(repo, branches, newLimiter(s.config.MaxConcurrency), deadlines)
+	timedOut := make(BranchesError)
+	for branch, stats := range result.Branches {
+		if errors.Is(stats.Err, context.DeadlineExceeded) || errors.Is(stats.Err, context.Canceled) {
+			timedOut[branch] = stats.Err
+		}
+	}
+	if len(timedOut) == 0 {
+		if err != nil && s.config.ErrorPolicy != ErrorPolicyCollect {
+			return nil, err
+		}
+		return result.Images, err
+	}
+	if branchErrors, ok := err.(BranchesError); ok {
+		return result.Images, branchErrors
+	}
+	return result.Images, timedOut
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGetRepositoryWithDeadline(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {
+			"master-1500000100-bcdef0":  testDigest("a"),
+			"feature-1500000200-cdef01": testDigest("b"),
+		},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/feature-") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:           server.URL,
+		BranchPrefixTags:  true,
+		FetchManifestInfo: true,
+		MaxConcurrency:    1,
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	images, err := testService.GetRepositoryWithDeadline(ctx, "vili", []string{"feature", "master"})
+	assert.True(t, time.Since(start) < time.Second)
+	if assert.IsType(t, BranchesError{}, err) {
+		assert.Contains(t, err.(BranchesError), "feature")
+		assert.Len(t, err.(BranchesError), 1)
+	}
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "master-1500000100-bcdef0", images[0].Tag)
+	}
+
+	images, err = testService.GetRepositoryWithDeadline(context.Background(), "vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+}
+
+// roundTripperFunc is an http.RoundTripper calling a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestContextTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var seenID string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seenID = RequestIDFromContext(req.Context())
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	httpClient := &http.Client{Transport: &contextTransport{base: base, ctx: ctx}}
+
+	// the request's own context values are kept
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := httpClient.Do(req.WithContext(WithRequestID(context.Background(), "abc123")))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+	assert.Equal(t, "abc123", seenID)
+
+	// the request's own cancellation is honored
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer reqCancel()
+	req, _ = http.NewRequest("GET", server.URL+"/slow", nil)
+	_, err = httpClient.Do(req.WithContext(reqCtx))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	// the transport's deadline is honored
+	deadlineCtx, deadlineCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer deadlineCancel()
+	deadlineClient := &http.Client{Transport: &contextTransport{base: base, ctx: deadlineCtx}}
+	_, err = deadlineClient.Get(server.URL + "/slow")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	// as is the transport's cancellation
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = httpClient.Get(server.URL + "/slow")
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+}
@@ -0,0 +1,297 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// defaultPlatform is the platform resolved from manifest lists when inspecting images,
+// unless DefaultPlatform is set
+var defaultPlatform = manifestPlatform{OS: "linux", Architecture: "amd64"}
+
+// ImageDetails holds the metadata recorded in an image's manifest and configuration.
+// For artifacts other than images, such as Helm charts, ArtifactType is set and the
+// config is not inspected, so Created and Labels are empty.
+type ImageDetails struct {
+	Digest          string            `json:"digest,omitempty"`
+	MediaType       string            `json:"mediaType"`
+	ConfigMediaType string            `json:"configMediaType,omitempty"`
+	ArtifactType    string            `json:"artifactType,omitempty"`
+	Created         time.Time         `json:"created"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Layers          []LayerDescriptor `json:"layers,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// LayerDescriptor references a layer of an image or artifact
+type LayerDescriptor struct {
+	MediaType string `json:"mediaType,omitempty"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+// HistoryEntry is a step in the build history of an image
+type HistoryEntry struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// imageConfig is the subset of the image configuration used by the package. It is
+// also the format of the v1Compatibility entries in schema1 manifests.
+type imageConfig struct {
+	Created time.Time `json:"created"`
+	Config  struct {
+		Labels       map[string]string   `json:"Labels"`
+		Env          []string            `json:"Env"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		User         string              `json:"User"`
+	} `json:"config"`
+	History []HistoryEntry `json:"history"`
+}
+
+// RuntimeConfig is the runtime configuration declared by an image
+type RuntimeConfig struct {
+	Env []string `json:"env,omitempty"`
+	// ExposedPorts are the sorted exposed ports, of the form <port>/<protocol>
+	ExposedPorts []string `json:"exposedPorts,omitempty"`
+	Entrypoint   []string `json:"entrypoint,omitempty"`
+	Cmd          []string `json:"cmd,omitempty"`
+	WorkingDir   string   `json:"workingDir,omitempty"`
+	User         string   `json:"user,omitempty"`
+}
+
+// GetImageDetails returns the creation time and labels of the image with the given tag,
+// along with its layers and annotations. Artifacts are inspected as in ImageDetails.
+// Manifest lists are resolved to their image for the DefaultPlatform, linux/amd64 by
+// default, or to their first image if there is none. Schema1 manifests are only
+// inspected if AllowSchema1 is set.
+func (s *RegistryService) GetImageDetails(repo, tag string) (*ImageDetails, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	m, err := s.getImageManifest(httpClient, repoNameRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	details := &ImageDetails{
+		Digest:       m.digest,
+		MediaType:    m.MediaType,
+		ArtifactType: m.artifactType(),
+		Annotations:  m.Annotations,
+	}
+	if m.Config != nil {
+		details.ConfigMediaType = m.Config.MediaType
+	}
+	for _, layer := range m.Layers {
+		details.Layers = append(details.Layers, LayerDescriptor{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+	if details.ArtifactType != "" {
+		return details, nil
+	}
+
+	config, err := s.readImageConfig(httpClient, repoNameRef, tag, m)
+	if err != nil {
+		return nil, err
+	}
+	details.Created = config.Created
+	details.Labels = config.Config.Labels
+	return details, nil
+}
+
+// GetImageDetailsByDigest returns the details of the image with the given manifest digest,
+// like GetImageDetails. Unlike a tag, the digest can't move to another image between
+// listing images and inspecting them.
+func (s *RegistryService) GetImageDetailsByDigest(repo, digest string) (*ImageDetails, error) {
+	dgst, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetImageDetails(repo, dgst.String())
+}
+
+// getImageConfig fetches the manifest and config of the image with the given tag or
+// digest, resolving manifest lists as in GetImageDetails. Artifacts other than images
+// are rejected with an ArtifactError, since they have no image config.
+func (s *RegistryService) getImageConfig(httpClient *http.Client, name reference.Named, ref string) (*manifest, *imageConfig, error) {
+	m, err := s.getImageManifest(httpClient, name, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if artifactType := m.artifactType(); artifactType != "" {
+		return nil, nil, &ArtifactError{Repo: name.Name(), Ref: ref, ArtifactType: artifactType}
+	}
+	config, err := s.readImageConfig(httpClient, name, ref, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, config, nil
+}
+
+// readImageConfig reads the config of the image with the given manifest. The config of
+// schema1 images is read from their manifest, and is empty if the manifest has no history.
+func (s *RegistryService) readImageConfig(httpClient *http.Client, name reference.Named, ref string, m *manifest) (*imageConfig, error) {
+	config := &imageConfig{}
+	if schemaVersion(m.MediaType) == 1 || m.SchemaVersion == 1 {
+		if !s.config.AllowSchema1 {
+			return nil, ErrSchema1Manifest
+		}
+		if len(m.History) == 0 {
+			return config, nil
+		}
+		if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), config); err != nil {
+			return nil, err
+		}
+	} else {
+		if m.Config == nil {
+			return nil, fmt.Errorf("manifest for %s:%s has no config", name.Name(), ref)
+		}
+		if err := s.getBlobJSON(httpClient, name, m.Config.Digest, config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// GetRuntimeConfig returns the environment, exposed ports, entrypoint, command, working
+// directory and user declared by the image with the given tag. Manifest lists are
+// resolved as in GetImageDetails.
+func (s *RegistryService) GetRuntimeConfig(repo, tag string) (*RuntimeConfig, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	_, config, err := s.getImageConfig(httpClient, repoNameRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	runtimeConfig := &RuntimeConfig{
+		Env:        config.Config.Env,
+		Entrypoint: config.Config.Entrypoint,
+		Cmd:        config.Config.Cmd,
+		WorkingDir: config.Config.WorkingDir,
+		User:       config.Config.User,
+	}
+	for port := range config.Config.ExposedPorts {
+		runtimeConfig.ExposedPorts = append(runtimeConfig.ExposedPorts, port)
+	}
+	sort.Strings(runtimeConfig.ExposedPorts)
+	return runtimeConfig, nil
+}
+
+// GetHistory returns the build history recorded in the config of the image with the
+// given tag, oldest first. Manifest lists are resolved and artifacts are rejected as in
+// GetImageDetails. The history of schema1 images is read from the v1Compatibility
+// entries of their manifest. Images whose config has no history return no entries.
+func (s *RegistryService) GetHistory(repo, tag string) ([]HistoryEntry, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	m, config, err := s.getImageConfig(httpClient, repoNameRef, tag)
+	if err != nil {
+		return nil, err
+	}
+	if schemaVersion(m.MediaType) == 1 || m.SchemaVersion == 1 {
+		return schema1History(m)
+	}
+	return config.History, nil
+}
+
+// schema1History returns the history of a schema1 image from the v1Compatibility
+// entries of its manifest, which are listed newest first
+func schema1History(m *manifest) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	for i := len(m.History) - 1; i >= 0; i-- {
+		var entry struct {
+			Created         time.Time `json:"created"`
+			ContainerConfig struct {
+				Cmd []string `json:"Cmd"`
+			} `json:"container_config"`
+			Throwaway bool `json:"throwaway"`
+		}
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &entry); err != nil {
+			return nil, err
+		}
+		history = append(history, HistoryEntry{
+			Created:    entry.Created,
+			CreatedBy:  strings.Join(entry.ContainerConfig.Cmd, " "),
+			EmptyLayer: entry.Throwaway,
+		})
+	}
+	return history, nil
+}
+
+// getImageManifest fetches the image manifest with the given tag or digest, resolving
+// manifest lists to the image for the default platform
+func (s *RegistryService) getImageManifest(httpClient *http.Client, name reference.Named, ref string) (*manifest, error) {
+	m, err := s.getManifest(httpClient, name, ref)
+	if err != nil || !m.isIndex() {
+		return m, err
+	}
+	child, err := s.platformManifest(m, name.Name(), ref)
+	if err != nil {
+		return nil, err
+	}
+	return s.getManifest(httpClient, name, child.Digest)
+}
+
+// platformManifest returns the descriptor of the manifest list's image for the
+// DefaultPlatform, or of its first image if there is none
+func (s *RegistryService) platformManifest(m *manifest, repo, ref string) (manifestDescriptor, error) {
+	if len(m.Manifests) == 0 {
+		return manifestDescriptor{}, fmt.Errorf("manifest list for %s:%s is empty", repo, ref)
+	}
+	platform, err := s.defaultPlatform()
+	if err != nil {
+		return manifestDescriptor{}, err
+	}
+	for _, candidate := range m.Manifests {
+		if candidate.Platform != nil && *candidate.Platform == platform {
+			return candidate, nil
+		}
+	}
+	return m.Manifests[0], nil
+}
+
+// defaultPlatform returns the platform resolved from manifest lists
+func (s *RegistryService) defaultPlatform() (manifestPlatform, error) {
+	if s.config.DefaultPlatform == "" {
+		return defaultPlatform, nil
+	}
+	parts := strings.Split(s.config.DefaultPlatform, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return manifestPlatform{}, fmt.Errorf("invalid default platform %q, expected os/arch", s.config.DefaultPlatform)
+	}
+	return manifestPlatform{OS: parts[0], Architecture: parts[1]}, nil
+}
+
+// getBlobJSON fetches the blob with the given digest and decodes it as JSON into v
+func (s *RegistryService) getBlobJSON(httpClient *http.Client, name reference.Named, blobDigest string, v interface{}) error {
+	resp, err := httpClient.Get(s.registryURL() + "/v2/" + name.Name() + "/blobs/" + blobDigest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return client.HandleErrorResponse(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGetImageDetails(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	schema2 := `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+		"config": {"mediaType": "application/vnd.docker.container.image.v1+json", "digest": "` + testDigest("c0") + `"}}`
+	reg.manifests = map[string]string{
+		"schema2":             schema2,
+		testDigest("schema2"): schema2,
+		"list": `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"digest": "` + testDigest("arm") + `", "platform": {"os": "linux", "architecture": "arm64"}},
+			{"digest": "` + testDigest("schema2") + `", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+		"schema1": `{"schemaVersion": 1, "mediaType": "` + MediaTypeSignedSchema1 + `", "history": [
+			{"v1Compatibility": "{\"created\": \"2017-07-14T02:40:00Z\", \"config\": {\"Labels\": {\"revision\": \"abcdef\"}}}"}]}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"created": "2017-07-14T02:40:00Z", "config": {"Labels": {"revision": "bcdef0"}}}`,
+	}
+	created := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	for _, tag := range []string{"schema2", "list"} {
+		details, err := testService.GetImageDetails("vili", tag)
+		assert.NoError(t, err)
+		assert.Equal(t, MediaTypeSchema2, details.MediaType)
+		assert.True(t, created.Equal(details.Created))
+		assert.Equal(t, map[string]string{"revision": "bcdef0"}, details.Labels)
+	}
+
+	_, err := testService.GetImageDetails("vili", "schema1")
+	assert.Equal(t, ErrSchema1Manifest, err)
+
+	testService.config.AllowSchema1 = true
+	details, err := testService.GetImageDetails("vili", "schema1")
+	assert.NoError(t, err)
+	assert.True(t, created.Equal(details.Created))
+	assert.Equal(t, map[string]string{"revision": "abcdef"}, details.Labels)
+}
+
+func TestRegistryGetImageDetailsArtifact(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"chart": `{"schemaVersion": 2, "mediaType": "` + MediaTypeOCIManifest + `",
+			"config": {"mediaType": "application/vnd.cncf.helm.config.v1+json", "digest": "` + testDigest("c0") + `"},
+			"layers": [{"mediaType": "application/vnd.cncf.helm.chart.content.v1.tar+gzip", "digest": "` + testDigest("l0") + `", "size": 1024}],
+			"annotations": {"org.opencontainers.image.title": "vili"}}`,
+		"sbom": `{"schemaVersion": 2, "mediaType": "` + MediaTypeOCIManifest + `", "artifactType": "application/spdx+json",
+			"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "` + testDigest("c1") + `"}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	details, err := testService.GetImageDetails("vili", "chart")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/vnd.cncf.helm.config.v1+json", details.ArtifactType)
+	assert.Equal(t, "application/vnd.cncf.helm.config.v1+json", details.ConfigMediaType)
+	assert.Equal(t, []LayerDescriptor{{
+		MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+		Digest:    testDigest("l0"),
+		Size:      1024,
+	}}, details.Layers)
+	assert.Equal(t, map[string]string{"org.opencontainers.image.title": "vili"}, details.Annotations)
+	assert.True(t, details.Created.IsZero())
+
+	details, err = testService.GetImageDetails("vili", "sbom")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/spdx+json", details.ArtifactType)
+
+	_, err = testService.GetRuntimeConfig("vili", "chart")
+	assert.Error(t, err)
+}
+
+func TestRegistryGetImageDetailsByDigest(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"latest":             `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+		testDigest("pinned"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Labels": {"revision": "abcdef"}}}`,
+		testDigest("c1"): `{"config": {"Labels": {"revision": "bcdef0"}}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	details, err := testService.GetImageDetailsByDigest("vili", strings.ToUpper(testDigest("pinned")))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"revision": "abcdef"}, details.Labels)
+
+	_, err = testService.GetImageDetailsByDigest("vili", "latest")
+	assert.IsType(t, &InvalidDigestError{}, err)
+}
+
+func TestRegistryDefaultPlatform(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"list": `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "` + testDigest("arm64") + `", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		testDigest("amd64"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		testDigest("arm64"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Labels": {"arch": "amd64"}}}`,
+		testDigest("c1"): `{"config": {"Labels": {"arch": "arm64"}}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	details, err := testService.GetImageDetails("vili", "list")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"arch": "amd64"}, details.Labels)
+
+	testService.config.DefaultPlatform = "linux/arm64"
+	details, err = testService.GetImageDetails("vili", "list")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"arch": "arm64"}, details.Labels)
+
+	testService.config.DefaultPlatform = "arm64"
+	_, err = testService.GetImageDetails("vili", "list")
+	assert.EqualError(t, err, `invalid default platform "arm64", expected os/arch`)
+}
+
+func TestRegistryGetRuntimeConfig(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"master": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Env": ["PATH=/usr/bin", "PORT=8080"], "ExposedPorts": {"8080/tcp": {}, "443/tcp": {}},
+			"Entrypoint": ["/vili"], "Cmd": ["serve"], "WorkingDir": "/app", "User": "vili"}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	runtimeConfig, err := testService.GetRuntimeConfig("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, &RuntimeConfig{
+		Env:          []string{"PATH=/usr/bin", "PORT=8080"},
+		ExposedPorts: []string{"443/tcp", "8080/tcp"},
+		Entrypoint:   []string{"/vili"},
+		Cmd:          []string{"serve"},
+		WorkingDir:   "/app",
+		User:         "vili",
+	}, runtimeConfig)
+}
+
+func TestRegistryPlatformTagDigests(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("list"), "1500000100-bcdef0": testDigest("amd64")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		testDigest("list"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "` + testDigest("arm64") + `", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		testDigest("amd64"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	dgst, err := testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("list"), dgst)
+
+	testService.config.PlatformTagDigests = true
+	dgst, err = testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("amd64"), dgst)
+
+	testService.config.DefaultPlatform = "linux/arm64"
+	dgst, err = testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("arm64"), dgst)
+
+	dgst, err = testService.GetTag("vili", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("amd64"), dgst)
+}
+
+func TestRegistryAcceptedMediaTypes(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{}}
+	for _, mediaType := range []string{MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeManifestList, MediaTypeSchema2} {
+		assert.Contains(t, testService.acceptedMediaTypes(), mediaType)
+	}
+	assert.NotContains(t, testService.acceptedMediaTypes(), MediaTypeSignedSchema1)
+	assert.NotContains(t, testService.acceptedMediaTypes(), MediaTypeSchema1)
+	testService.config.AllowSchema1 = true
+	assert.Contains(t, testService.acceptedMediaTypes(), MediaTypeSignedSchema1)
+	assert.Contains(t, testService.acceptedMediaTypes(), MediaTypeSchema1)
+}
+
+func TestRegistryGetHistory(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"history": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"bare":    `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+		"schema1": `{"schemaVersion": 1, "mediaType": "` + MediaTypeSignedSchema1 + `", "history": [
+			{"v1Compatibility": "{\"created\": \"2017-07-14T02:41:00Z\", \"container_config\": {\"Cmd\": [\"/bin/sh\", \"-c\", \"#(nop) CMD [sh]\"]}, \"throwaway\": true}"},
+			{"v1Compatibility": "{\"created\": \"2017-07-14T02:40:00Z\", \"container_config\": {\"Cmd\": [\"/bin/sh\", \"-c\", \"#(nop) ADD file:abc in /\"]}}"}]}`,
+		"sbom": `{"schemaVersion": 2, "mediaType": "` + MediaTypeOCIManifest + `", "artifactType": "application/spdx+json",
+			"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "` + testDigest("c2") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"history": [
+			{"created": "2017-07-14T02:40:00Z", "created_by": "/bin/sh -c #(nop) ADD file:abc in /"},
+			{"created": "2017-07-14T02:41:00Z", "created_by": "/bin/sh -c #(nop) CMD [\"sh\"]", "empty_layer": true}]}`,
+		testDigest("c1"): `{}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	history, err := testService.GetHistory("vili", "history")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "/bin/sh -c #(nop) ADD file:abc in /", history[0].CreatedBy)
+	assert.False(t, history[0].EmptyLayer)
+	assert.True(t, history[1].EmptyLayer)
+	assert.True(t, time.Date(2017, 7, 14, 2, 41, 0, 0, time.UTC).Equal(history[1].Created))
+
+	history, err = testService.GetHistory("vili", "bare")
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	_, err = testService.GetHistory("vili", "schema1")
+	assert.Equal(t, ErrSchema1Manifest, err)
+	testService.config.AllowSchema1 = true
+	history, err = testService.GetHistory("vili", "schema1")
+	assert.NoError(t, err)
+	assert.Equal(t, []HistoryEntry{
+		{Created: time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC), CreatedBy: "/bin/sh -c #(nop) ADD file:abc in /"},
+		{Created: time.Date(2017, 7, 14, 2, 41, 0, 0, time.UTC), CreatedBy: "/bin/sh -c #(nop) CMD [sh]", EmptyLayer: true},
+	}, history)
+
+	_, err = testService.GetHistory("vili", "sbom")
+	assert.IsType(t, &ArtifactError{}, err)
+}
@@ -1,6 +1,13 @@
 package repository
 
-var dockerService DockerService
+import "sync"
+
+// dockerService is the docker service used by the package-level functions. It is
+// guarded by dockerServiceMutex, so that it can be re-initialized while in use.
+var (
+	dockerServiceMutex sync.RWMutex
+	dockerService      DockerService
+)
 
 // DockerService is a docker service instance that fetches images from a repository
 type DockerService interface {
@@ -9,17 +16,31 @@ type DockerService interface {
 	FullName(repo, tag string) (string, error)
 }
 
+// setDockerService replaces the docker service used by the package-level functions
+func setDockerService(service DockerService) {
+	dockerServiceMutex.Lock()
+	defer dockerServiceMutex.Unlock()
+	dockerService = service
+}
+
+// getDockerService returns the docker service used by the package-level functions
+func getDockerService() DockerService {
+	dockerServiceMutex.RLock()
+	defer dockerServiceMutex.RUnlock()
+	return dockerService
+}
+
 // GetDockerRepository returns the images in the given repository for the provided branch names
 func GetDockerRepository(repo string, branches []string) ([]*Image, error) {
-	return dockerService.GetRepository(repo, branches)
+	return getDockerService().GetRepository(repo, branches)
 }
 
 // GetDockerTag returns an image digest for the given tag
 func GetDockerTag(repo, tag string) (string, error) {
-	return dockerService.GetTag(repo, tag)
+	return getDockerService().GetTag(repo, tag)
 }
 
 // DockerFullName returns the complete docker image name
 func DockerFullName(repo, tag string) (string, error) {
-	return dockerService.FullName(repo, tag)
+	return getDockerService().FullName(repo, tag)
 }
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitRegistryConcurrentUse(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a")},
+	})
+	defer server.Close()
+	defer setDockerService(getDockerService())
+
+	assert.NoError(t, InitRegistry(&RegistryConfig{BaseURL: server.URL}))
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(2)
+		go func() {
+			defer waitGroup.Done()
+			digest, err := GetDockerTag("vili", "1500000000-abcdef")
+			assert.NoError(t, err)
+			assert.Equal(t, testDigest("a"), digest)
+		}()
+		go func() {
+			defer waitGroup.Done()
+			assert.NoError(t, InitRegistry(&RegistryConfig{BaseURL: server.URL}))
+		}()
+	}
+	waitGroup.Wait()
+}
@@ -51,7 +51,7 @@ func newECR(c *ECRConfig) *ECRService {
 
 // InitECR initializes the docker registry service
 func InitECR(c *ECRConfig) error {
-	dockerService = newECR(c)
+	setDockerService(newECR(c))
 	return nil
 }
 
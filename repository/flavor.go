@@ -0,0 +1,242 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/client"
+)
+
+// RegistryFlavor identifies a registry implementation that exposes vendor-specific
+// APIs beyond the docker distribution v2 API
+type RegistryFlavor string
+
+// Registry flavors
+const (
+	FlavorDistribution RegistryFlavor = ""
+	FlavorHarbor       RegistryFlavor = "harbor"
+	FlavorACR          RegistryFlavor = "acr"
+)
+
+// tagMetadata is the vendor-reported metadata of a tag
+type tagMetadata struct {
+	pushTime   time.Time
+	lastPulled time.Time
+	immutable  bool
+}
+
+// getTagMetadata returns the vendor-reported metadata for each tag in the repository,
+// or nil if the registry flavor does not report tag metadata
+func (s *RegistryService) getTagMetadata(repoName string) (map[string]*tagMetadata, error) {
+	fullRepoName := s.fullRepositoryName(repoName)
+	switch s.config.Flavor {
+	case FlavorHarbor:
+		return s.getHarborTagMetadata(fullRepoName)
+	case FlavorACR:
+		return s.getACRTagMetadata(fullRepoName)
+	default:
+		return nil, nil
+	}
+}
+
+// RepoLastUpdated returns the time the repository was last updated. Harbor and ACR
+// report it for the repository in a single request. Other registries have their tags
+// listed, and the latest tag timestamp is returned, or the zero time if no tag has one.
+func (s *RegistryService) RepoLastUpdated(repo string) (time.Time, error) {
+	fullRepoName := s.fullRepositoryName(repo)
+	var lastUpdated time.Time
+	var err error
+	switch s.config.Flavor {
+	case FlavorHarbor:
+		lastUpdated, err = s.getHarborUpdateTime(fullRepoName)
+	case FlavorACR:
+		lastUpdated, err = s.getACRUpdateTime(fullRepoName)
+	}
+	if err != nil || !lastUpdated.IsZero() {
+		return lastUpdated, err
+	}
+
+	repository, err := s.getRepository(repo)
+	if err != nil {
+		return time.Time{}, err
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, tag := range tags {
+		if parsed, ok := s.splitTag(tag); ok && parsed.lastModified.After(lastUpdated) {
+			lastUpdated = parsed.lastModified
+		}
+	}
+	return lastUpdated, nil
+}
+
+// getHarborUpdateTime reads the update time of the repository from the Harbor
+// repositories API
+func (s *RegistryService) getHarborUpdateTime(fullRepoName string) (time.Time, error) {
+	sepIndex := strings.Index(fullRepoName, "/")
+	if sepIndex == -1 {
+		return time.Time{}, fmt.Errorf("harbor repository %s is not in a project", fullRepoName)
+	}
+	project, repo := fullRepoName[:sepIndex], fullRepoName[sepIndex+1:]
+	u := fmt.Sprintf("%s/api/v2.0/projects/%s/repositories/%s",
+		s.registryURL(), url.PathEscape(project), url.PathEscape(url.PathEscape(repo)))
+	var repository struct {
+		UpdateTime time.Time `json:"update_time"`
+	}
+	if _, err := s.getVendorJSON(u, &repository); err != nil {
+		return time.Time{}, err
+	}
+	return repository.UpdateTime, nil
+}
+
+// getACRUpdateTime reads the last update time of the repository from the Azure
+// Container Registry repository API
+func (s *RegistryService) getACRUpdateTime(fullRepoName string) (time.Time, error) {
+	var repository struct {
+		LastUpdateTime time.Time `json:"lastUpdateTime"`
+	}
+	if _, err := s.getVendorJSON(fmt.Sprintf("%s/acr/v1/%s", s.registryURL(), fullRepoName), &repository); err != nil {
+		return time.Time{}, err
+	}
+	return repository.LastUpdateTime, nil
+}
+
+// setTagMetadata populates the image from the vendor-reported tag metadata
+func (s *RegistryService) setTagMetadata(image *Image, metadata *tagMetadata) {
+	if s.config.UsePushTime && !metadata.pushTime.IsZero() {
+		image.LastModified = metadata.pushTime
+	}
+	if s.config.FetchTagMetadata {
+		if !metadata.lastPulled.IsZero() {
+			lastPulled := metadata.lastPulled
+			image.LastPulled = &lastPulled
+		}
+		image.Immutable = metadata.immutable
+	}
+}
+
+// getHarborTagMetadata reads tag metadata from the Harbor artifacts API
+func (s *RegistryService) getHarborTagMetadata(fullRepoName string) (map[string]*tagMetadata, error) {
+	sepIndex := strings.Index(fullRepoName, "/")
+	if sepIndex == -1 {
+		return nil, fmt.Errorf("harbor repository %s is not in a project", fullRepoName)
+	}
+	project, repo := fullRepoName[:sepIndex], fullRepoName[sepIndex+1:]
+	// harbor requires slashes in repository names to be double escaped
+	u := fmt.Sprintf("%s/api/v2.0/projects/%s/repositories/%s/artifacts?with_tag=true&page_size=100",
+		s.registryURL(), url.PathEscape(project), url.PathEscape(url.PathEscape(repo)))
+
+	metadata := make(map[string]*tagMetadata)
+	for u != "" {
+		var artifacts []struct {
+			Tags []struct {
+				Name      string    `json:"name"`
+				PushTime  time.Time `json:"push_time"`
+				PullTime  time.Time `json:"pull_time"`
+				Immutable bool      `json:"immutable"`
+			} `json:"tags"`
+		}
+		next, err := s.getVendorJSON(u, &artifacts)
+		if err != nil {
+			return nil, err
+		}
+		for _, artifact := range artifacts {
+			for _, tag := range artifact.Tags {
+				metadata[tag.Name] = &tagMetadata{
+					pushTime:   tag.PushTime,
+					lastPulled: tag.PullTime,
+					immutable:  tag.Immutable,
+				}
+			}
+		}
+		u = next
+	}
+	return metadata, nil
+}
+
+// getACRTagMetadata reads tag metadata from the Azure Container Registry tags API.
+// ACR does not report pull times.
+func (s *RegistryService) getACRTagMetadata(fullRepoName string) (map[string]*tagMetadata, error) {
+	u := fmt.Sprintf("%s/acr/v1/%s/_tags?n=100", s.registryURL(), fullRepoName)
+
+	metadata := make(map[string]*tagMetadata)
+	for u != "" {
+		var tagsResponse struct {
+			Tags []struct {
+				Name                 string    `json:"name"`
+				LastUpdateTime       time.Time `json:"lastUpdateTime"`
+				ChangeableAttributes struct {
+					WriteEnabled *bool `json:"writeEnabled"`
+				} `json:"changeableAttributes"`
+			} `json:"tags"`
+		}
+		next, err := s.getVendorJSON(u, &tagsResponse)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tagsResponse.Tags {
+			writeEnabled := tag.ChangeableAttributes.WriteEnabled
+			metadata[tag.Name] = &tagMetadata{
+				pushTime:  tag.LastUpdateTime,
+				immutable: writeEnabled != nil && !*writeEnabled,
+			}
+		}
+		u = next
+	}
+	return metadata, nil
+}
+
+// getVendorJSON fetches and decodes a vendor API response, authenticating with the
+// registry credentials. It returns the URL of the next page, if any.
+func (s *RegistryService) getVendorJSON(u string, v interface{}) (string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	if s.config.Username != "" || s.config.Password != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := &http.Client{Transport: s.baseTransport()}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return "", client.HandleErrorResponse(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+
+	link := nextLink(resp.Header.Get("Link"))
+	if link == "" {
+		return "", nil
+	}
+	next, err := resp.Request.URL.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	return next.String(), nil
+}
+
+// nextLink returns the rel="next" URL from a Link header, or "" if there is none
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		for _, param := range parts[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryACRPushTimes(t *testing.T) {
+	pushTime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	reg := &testRegistry{
+		tags: map[string]map[string]string{
+			"vili": {
+				"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+				"v1.0.0":            "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", reg)
+	mux.HandleFunc("/acr/v1/vili/_tags", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tags": []map[string]interface{}{
+				{"name": "v1.0.0", "lastUpdateTime": pushTime},
+			},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:     server.URL,
+			Flavor:      FlavorACR,
+			UsePushTime: true,
+		},
+	}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "v1.0.0", images[0].Tag)
+	assert.True(t, pushTime.Equal(images[0].LastModified))
+	assert.Equal(t, int64(1500000000), images[1].LastModified.Unix())
+}
+
+func TestRegistryRepoLastUpdated(t *testing.T) {
+	updateTime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	reg := &testRegistry{
+		tags: map[string]map[string]string{
+			"vili": {
+				"1500000000-abcdef": testDigest("a"),
+				"1500000100-bcdef0": testDigest("b"),
+				"latest":            testDigest("b"),
+			},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", reg)
+	mux.HandleFunc("/acr/v1/vili", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"lastUpdateTime": updateTime})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	lastUpdated, err := testService.RepoLastUpdated("vili")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000100), lastUpdated.Unix())
+
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Flavor: FlavorACR}}
+	lastUpdated, err = testService.RepoLastUpdated("vili")
+	assert.NoError(t, err)
+	assert.True(t, updateTime.Equal(lastUpdated))
+}
+
+func TestNextLink(t *testing.T) {
+	assert.Equal(t, "", nextLink(""))
+	assert.Equal(t, "/acr/v1/vili/_tags?last=b&n=100",
+		nextLink(`</acr/v1/vili/_tags?last=b&n=100>; rel="next"`))
+	assert.Equal(t, "/api/v2.0/artifacts?page=3",
+		nextLink(`</api/v2.0/artifacts?page=1>; rel="prev" , </api/v2.0/artifacts?page=3>; rel="next"`))
+}
+
+func TestRegistryHarborRobotAccount(t *testing.T) {
+	const username, password = "robot$ci", "s3cr3t"
+	var tokenAuthorized, harborAuthorized bool
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/service/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != username || pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		tokenAuthorized = true
+		json.NewEncoder(w).Encode(map[string]string{"token": "robot-token"})
+	})
+	mux.HandleFunc("/api/v2.0/projects/library/repositories/vili/artifacts", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		harborAuthorized = user == username && pass == password
+		w.Write([]byte("[]"))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if r.Header.Get("Authorization") != "Bearer robot-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/service/token",service="harbor-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "library/vili", "tags": []string{"1500000000-abcdef"}})
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:     server.URL,
+			Username:    username,
+			Password:    password,
+			Namespace:   "library",
+			Flavor:      FlavorHarbor,
+			UsePushTime: true,
+		},
+	}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.True(t, tokenAuthorized)
+	assert.True(t, harborAuthorized)
+}
+
+func TestRegistryHarborTagMetadata(t *testing.T) {
+	pushTime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	pullTime := time.Date(2018, 2, 3, 4, 5, 6, 0, time.UTC)
+	reg := &testRegistry{
+		tags: map[string]map[string]string{
+			"library/vili": {
+				"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+				"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/v2/", reg)
+	mux.HandleFunc("/api/v2.0/projects/library/repositories/vili/artifacts", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"tags": []map[string]interface{}{
+				{"name": "1500000000-abcdef", "push_time": pushTime, "pull_time": pullTime, "immutable": true},
+			}},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:          server.URL,
+			Namespace:        "library",
+			Flavor:           FlavorHarbor,
+			FetchTagMetadata: true,
+		},
+	}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Nil(t, images[0].LastPulled)
+	assert.False(t, images[0].Immutable)
+	assert.True(t, pullTime.Equal(*images[1].LastPulled))
+	assert.True(t, images[1].Immutable)
+	assert.Equal(t, int64(1500000000), images[1].LastModified.Unix())
+}
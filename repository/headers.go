@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// headerRecorder records the headers of the last response to the requests made
+// through the transports it wraps
+type headerRecorder struct {
+	mutex  sync.Mutex
+	header http.Header
+}
+
+// wrap wraps the transport to record its response headers. A nil headerRecorder
+// records nothing.
+func (r *headerRecorder) wrap(transport http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return transport
+	}
+	return &headerTransport{base: transport, recorder: r}
+}
+
+// headers returns the recorded response headers
+func (r *headerRecorder) headers() http.Header {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.header
+}
+
+// headerTransport is an http.RoundTripper that records its response headers
+type headerTransport struct {
+	base     http.RoundTripper
+	recorder *headerRecorder
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if resp != nil {
+		t.recorder.mutex.Lock()
+		t.recorder.header = resp.Header.Clone()
+		t.recorder.mutex.Unlock()
+	}
+	return resp, err
+}
+
+// GetTagWithHeaders returns the digest of the tag like GetTag, along with the headers
+// of the registry's response, such as Docker-Content-Digest and RateLimit-Remaining,
+// for debugging. The tag is only looked up in the registry at BaseURL. The headers are
+// returned with the error if the registry responded.
+func (s *RegistryService) GetTagWithHeaders(repo, tag string) (string, http.Header, error) {
+	tag, err := s.resolveTag(tag)
+	if err != nil {
+		return "", nil, err
+	}
+	recorder := &headerRecorder{}
+	dgst, err := s.getTag(context.Background(), repo, tag, recorder)
+	return dgst, recorder.headers(), err
+}
+
+// GetManifestHeaders fetches the manifest with the given tag or digest and returns the
+// headers of the registry's response, such as Docker-Content-Digest, RateLimit-Remaining
+// and the caching headers, for debugging
+func (s *RegistryService) GetManifestHeaders(repo, ref string) (http.Header, error) {
+	ref, err := s.resolveTag(ref)
+	if err != nil {
+		return nil, err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &headerRecorder{}
+	httpClient := &http.Client{Transport: recorder.wrap(transport)}
+	_, err = s.getManifest(httpClient, repoNameRef, ref)
+	return recorder.headers(), err
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryResponseHeaders(t *testing.T) {
+	reg := &testRegistry{
+		tags: map[string]map[string]string{
+			"vili": {"1500000000-abcdef": testDigest("a")},
+		},
+		manifests: map[string]string{
+			"1500000000-abcdef": `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`,
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", "99;w=21600")
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	digest, header, err := testService.GetTagWithHeaders("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("a"), digest)
+	assert.Equal(t, "99;w=21600", header.Get("RateLimit-Remaining"))
+	assert.Equal(t, testDigest("a"), header.Get("Docker-Content-Digest"))
+
+	_, header, err = testService.GetTagWithHeaders("vili", "missing")
+	assert.Error(t, err)
+	assert.Equal(t, "99;w=21600", header.Get("RateLimit-Remaining"))
+
+	header, err = testService.GetManifestHeaders("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, "99;w=21600", header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "application/vnd.docker.distribution.manifest.v2+json", header.Get("Content-Type"))
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// hedgeResult is the answer of one of the requests of a hedged tag lookup
+type hedgeResult struct {
+	digest  string
+	err     error
+	primary bool
+}
+
+// hedgedGetTag looks up the tag in the registry, and in the primary registry too if the
+// registry hasn't answered within HedgeDelay or doesn't know the tag. The first
+// successful answer is returned and the other request is cancelled. If both fail, the
+// registry's error is returned, unless it didn't know the tag.
+func (s *RegistryService) hedgedGetTag(repo, tag string) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan hedgeResult, 2)
+	get := func(service *RegistryService, primary bool) {
+		dgst, err := service.getTag(ctx, repo, tag, nil)
+		results <- hedgeResult{digest: dgst, err: err, primary: primary}
+	}
+	go get(s, false)
+
+	timer := time.NewTimer(s.config.HedgeDelay)
+	defer timer.Stop()
+	hedge := timer.C
+	pending := 1
+	var baseErr, primaryErr error
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			pending++
+			go get(s.primary(), true)
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.digest, nil
+			}
+			if result.primary {
+				primaryErr = result.err
+			} else {
+				baseErr = result.err
+				if hedge != nil {
+					if !isNotFound(baseErr) {
+						return "", baseErr
+					}
+					timer.Stop()
+					hedge = nil
+					pending++
+					go get(s.primary(), true)
+				}
+			}
+			if pending == 0 {
+				if isNotFound(baseErr) {
+					return "", primaryErr
+				}
+				return "", baseErr
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// defaultTagPageSize is the default number of tags fetched per page by a RepositoryIterator
+const defaultTagPageSize = 100
+
+// RepositoryIterator yields the images of a repository one at a time, fetching the
+// repository's tags a page at a time as they are needed.
+//
+// Since later pages have not been fetched when the first images are returned, images
+// are only sorted within each page, by the configured SortOrder. Registries return
+// tags in lexical order, so there is no ordering across pages. Vendor tag metadata is
+// not populated, as the vendor APIs can only be listed in full.
+type RepositoryIterator struct {
+	service  *RegistryService
+	branches []string
+	pageSize int
+
+	name       reference.Named
+	transport  http.RoundTripper
+	httpClient *http.Client
+	err        error
+
+	started  bool
+	nextPage string
+	buffer   []*Image
+	closed   bool
+}
+
+// IterateRepository returns an iterator over the images in the repository for the
+// given branches, or for all branches if none are given. Tags are fetched in pages of
+// pageSize tags, or 100 by default.
+func (s *RegistryService) IterateRepository(repo string, branches []string, pageSize int) *RepositoryIterator {
+	if pageSize <= 0 {
+		pageSize = defaultTagPageSize
+	}
+	it := &RepositoryIterator{
+		service:  s,
+		branches: branches,
+		pageSize: pageSize,
+	}
+	it.name, it.transport, it.err = s.getRepositoryTransport(repo)
+	if it.err == nil {
+		it.httpClient = &http.Client{Transport: it.transport}
+	}
+	return it
+}
+
+// Next returns the next image in the repository, fetching the next page of tags if
+// needed. It returns io.EOF when there are no more images or the iterator is closed.
+func (it *RepositoryIterator) Next(ctx context.Context) (*Image, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	for len(it.buffer) == 0 {
+		if it.closed || (it.started && it.nextPage == "") {
+			return nil, io.EOF
+		}
+		if err := it.fetchPage(ctx); err != nil {
+			return nil, err
+		}
+	}
+	image := it.buffer[0]
+	it.buffer = it.buffer[1:]
+	return image, nil
+}
+
+// Close stops the iteration, after which Next returns io.EOF
+func (it *RepositoryIterator) Close() error {
+	it.closed = true
+	it.buffer = nil
+	return nil
+}
+
+// fetchPage fetches the next page of tags into the buffer
+func (it *RepositoryIterator) fetchPage(ctx context.Context) error {
+	s := it.service
+	u := it.nextPage
+	if !it.started {
+		u = s.tagsPageURL(it.name, it.pageSize)
+	}
+	tags, nextPage, err := getTagsPage(ctx, it.httpClient, u)
+	if err != nil {
+		return err
+	}
+
+	images := it.parseTags(tags)
+	if s.config.FetchManifestInfo || s.config.ResolveDigests || s.config.Dedupe {
+		if images, err = s.setManifestInfo(images, it.name, it.transport); err != nil {
+			return err
+		}
+	}
+	if s.config.LabelSelector != "" || s.branchFromLabel() {
+		if images, err = s.filterByLabels(images, it.name, it.transport); err != nil {
+			return err
+		}
+	}
+	s.sortImages(images)
+
+	it.started = true
+	it.nextPage = nextPage
+	it.buffer = images
+	return nil
+}
+
+// parseTags parses the images for the iterator's branches from a page of tags. If no
+// branches were given, branch-prefixed tags are attributed to the branch in the tag.
+func (it *RepositoryIterator) parseTags(tags []string) []*Image {
+	s := it.service
+	var images []*Image
+	now := s.now()
+	for _, tag := range tags {
+		if len(it.branches) == 0 {
+			if s.config.BranchPrefixTags {
+				parsed, ok := s.splitTag(tag)
+				if !ok {
+					continue
+				}
+				if image, ok := s.parseTag(tag, parsed.branch); ok && s.admitImage(image, now) {
+					images = append(images, image)
+				}
+			} else if image, ok := s.parseTag(tag, ""); ok && s.admitImage(image, now) {
+				images = append(images, image)
+			}
+			continue
+		}
+		for _, branch := range it.branches {
+			if image, ok := s.parseTag(tag, branch); ok && s.admitImage(image, now) {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// ListProgress is the progress of a tag listing
+type ListProgress struct {
+	// Pages is the number of pages of tags fetched
+	Pages int
+	// Tags is the number of tags fetched
+	Tags int
+}
+
+// ListTags lists the repository's tags a page of pageSize tags at a time, 100 by
+// default, calling progress after each page. If ctx is cancelled mid-listing, the tags
+// fetched so far are returned with a *ListCancelledError.
+func (s *RegistryService) ListTags(ctx context.Context, repo string, pageSize int, progress func(ListProgress)) ([]string, error) {
+	if pageSize <= 0 {
+		pageSize = defaultTagPageSize
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	var tags []string
+	var listProgress ListProgress
+	for u := s.tagsPageURL(repoNameRef, pageSize); u != ""; {
+		if err := ctx.Err(); err != nil {
+			return tags, &ListCancelledError{Tags: len(tags), Err: err}
+		}
+		var page []string
+		page, u, err = getTagsPage(ctx, httpClient, u)
+		if err != nil {
+			if ctx.Err() != nil {
+				return tags, &ListCancelledError{Tags: len(tags), Err: ctx.Err()}
+			}
+			return tags, err
+		}
+		tags = append(tags, page...)
+		listProgress.Pages++
+		listProgress.Tags = len(tags)
+		if progress != nil {
+			progress(listProgress)
+		}
+	}
+	return tags, nil
+}
+
+// tagsPageURL returns the URL of the first page of the repository's tags
+func (s *RegistryService) tagsPageURL(name reference.Named, pageSize int) string {
+	return fmt.Sprintf("%s/v2/%s/tags/list?n=%d", s.registryURL(), name.Name(), pageSize)
+}
+
+// getTagsPage fetches a page of tags, returning the URL of the next page, or "" if
+// there is none
+func getTagsPage(ctx context.Context, httpClient *http.Client, u string) ([]string, string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return nil, "", unknownError(client.HandleErrorResponse(resp))
+	}
+	var page struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", err
+	}
+
+	link := nextLink(resp.Header.Get("Link"))
+	if link == "" {
+		return page.Tags, "", nil
+	}
+	next, err := resp.Request.URL.Parse(link)
+	if err != nil {
+		return nil, "", err
+	}
+	return page.Tags, next.String(), nil
+}
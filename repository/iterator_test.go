@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryIterateRepository(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-aaaaaa": testDigest("a"),
+			"1500000002-bbbbbb": testDigest("b"),
+			"1500000001-cccccc": testDigest("c"),
+			"1500000003-dddddd": testDigest("d"),
+			"1500000004-eeeeee": testDigest("e"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	it := testService.IterateRepository("vili", []string{"master"}, 2)
+	var tags []string
+	for {
+		image, err := it.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "master", image.Branch)
+		tags = append(tags, image.Tag)
+	}
+	// images are sorted within each page of tags
+	assert.Equal(t, []string{
+		"1500000001-cccccc",
+		"1500000000-aaaaaa",
+		"1500000003-dddddd",
+		"1500000002-bbbbbb",
+		"1500000004-eeeeee",
+	}, tags)
+
+	listings := 0
+	for _, req := range reg.requests {
+		if req.URL.Path == "/v2/vili/tags/list" {
+			listings++
+		}
+	}
+	assert.Equal(t, 3, listings)
+
+	it = testService.IterateRepository("vili", nil, 2)
+	image, err := it.Next(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "1500000001-cccccc", image.Tag)
+	assert.NoError(t, it.Close())
+	_, err = it.Next(context.Background())
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRegistryListTags(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"a": testDigest("a"), "b": testDigest("b"), "c": testDigest("c")},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	var progress []ListProgress
+	tags, err := testService.ListTags(context.Background(), "vili", 2, func(p ListProgress) {
+		progress = append(progress, p)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, tags)
+	assert.Equal(t, []ListProgress{{Pages: 1, Tags: 2}, {Pages: 2, Tags: 3}}, progress)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tags, err = testService.ListTags(ctx, "vili", 2, func(ListProgress) {
+		cancel()
+	})
+	var cancelled *ListCancelledError
+	assert.True(t, errors.As(err, &cancelled))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, []string{"a", "b"}, tags)
+}
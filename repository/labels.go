@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+)
+
+// labelRequirement is a requirement of a LabelSelector, that a label exists or has a value
+type labelRequirement struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// parseLabelSelector parses a comma-separated list of key=value and key requirements
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		requirement := labelRequirement{key: part}
+		if sepIndex := strings.Index(part, "="); sepIndex != -1 {
+			requirement = labelRequirement{
+				key:      strings.TrimSpace(part[:sepIndex]),
+				value:    strings.TrimSpace(part[sepIndex+1:]),
+				hasValue: true,
+			}
+		}
+		if requirement.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", selector)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// matchLabels returns whether the labels satisfy all of the requirements
+func matchLabels(requirements []labelRequirement, labels map[string]string) bool {
+	for _, requirement := range requirements {
+		value, ok := labels[requirement.key]
+		if !ok || (requirement.hasValue && value != requirement.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterByLabels returns the images whose config labels match the LabelSelector,
+// fetching the config of each image with bounded concurrency. If the branch is read
+// from the BranchLabel, each image's Branch is set from its label, and images labeled
+// with a branch other than the one they were listed for are dropped. Artifacts other
+// than images have no labels, and are dropped.
+func (s *RegistryService) filterByLabels(images []*Image, name reference.Named, transport http.RoundTripper) ([]*Image, error) {
+	var requirements []labelRequirement
+	if s.config.LabelSelector != "" {
+		var err error
+		if requirements, err = parseLabelSelector(s.config.LabelSelector); err != nil {
+			return nil, err
+		}
+	}
+	lim := newLimiter(s.manifestConcurrency())
+	httpClient := &http.Client{Transport: transport}
+
+	var waitGroup sync.WaitGroup
+	labels := make([]map[string]string, len(images))
+	artifacts := make([]bool, len(images))
+	errChan := make(chan error, len(images))
+	for i, image := range images {
+		waitGroup.Add(1)
+		go func(i int, image *Image) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			_, config, err := s.getImageConfig(httpClient, name, image.Tag)
+			var artifactErr *ArtifactError
+			if errors.As(err, &artifactErr) {
+				artifacts[i] = true
+				return
+			}
+			if err != nil {
+				errChan <- err
+				return
+			}
+			labels[i] = config.Config.Labels
+		}(i, image)
+	}
+	waitGroup.Wait()
+	close(errChan)
+
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	var filtered []*Image
+	for i, image := range images {
+		if artifacts[i] || !matchLabels(requirements, labels[i]) {
+			continue
+		}
+		if s.branchFromLabel() {
+			branch := labels[i][s.config.BranchLabel]
+			if image.Branch != "" && branch != image.Branch {
+				continue
+			}
+			image.Branch = branch
+		}
+		filtered = append(filtered, image)
+	}
+	return filtered, nil
+}
+
+// branchFromLabel returns whether the branch of images is read from the BranchLabel,
+// which is only the case if the branch is not in the tags
+func (s *RegistryService) branchFromLabel() bool {
+	return s.config.BranchLabel != "" && !s.config.BranchPrefixTags
+}
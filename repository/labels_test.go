@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	requirements, err := parseLabelSelector("com.example.release=true, com.example.team")
+	assert.NoError(t, err)
+	assert.Equal(t, []labelRequirement{
+		{key: "com.example.release", value: "true", hasValue: true},
+		{key: "com.example.team"},
+	}, requirements)
+	assert.True(t, matchLabels(requirements, map[string]string{"com.example.release": "true", "com.example.team": ""}))
+	assert.False(t, matchLabels(requirements, map[string]string{"com.example.release": "false", "com.example.team": "ci"}))
+	assert.False(t, matchLabels(requirements, map[string]string{"com.example.release": "true"}))
+
+	_, err = parseLabelSelector("release=true,")
+	assert.Error(t, err)
+	_, err = parseLabelSelector("=true")
+	assert.Error(t, err)
+}
+
+func TestRegistryLabelSelector(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-aaaaaa": testDigest("a"), "1500000001-bbbbbb": testDigest("b")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"1500000000-aaaaaa": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"1500000001-bbbbbb": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Labels": {"com.example.release": "true"}}}`,
+		testDigest("c1"): `{"config": {"Labels": {}}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, LabelSelector: "com.example.release=true"}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "1500000000-aaaaaa", images[0].Tag)
+	}
+}
+
+func TestRegistryLabelSelectorSkipsArtifacts(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-aaaaaa": testDigest("a"), "1500000001-sbom00": testDigest("b")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"1500000000-aaaaaa": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"1500000001-sbom00": `{"schemaVersion": 2, "mediaType": "` + MediaTypeOCIManifest + `", "artifactType": "application/spdx+json",
+			"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "` + testDigest("c1") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Labels": {"com.example.release": "true", "git.branch": "master"}}}`,
+	}
+
+	for _, config := range []*RegistryConfig{
+		{BaseURL: server.URL, LabelSelector: "com.example.release=true"},
+		{BaseURL: server.URL, LabelSelector: "git.branch"},
+		{BaseURL: server.URL, BranchLabel: "git.branch"},
+	} {
+		testService := &RegistryService{config: config}
+		images, err := testService.GetRepository("vili", nil)
+		assert.NoError(t, err)
+		if assert.Len(t, images, 1) {
+			assert.Equal(t, "1500000000-aaaaaa", images[0].Tag)
+		}
+	}
+}
+
+func TestRegistryBranchLabel(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-aaaaaa": testDigest("a"), "1500000001-bbbbbb": testDigest("b")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"1500000000-aaaaaa": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"1500000001-bbbbbb": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+	}
+	reg.blobContents = map[string]string{
+		testDigest("c0"): `{"config": {"Labels": {"git.branch": "master"}}}`,
+		testDigest("c1"): `{"config": {"Labels": {"git.branch": "feature"}}}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, BranchLabel: "git.branch"}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "1500000000-aaaaaa", images[0].Tag)
+		assert.Equal(t, "master", images[0].Branch)
+	}
+
+	images, err = testService.GetRepository("vili", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, "feature", images[0].Branch)
+		assert.Equal(t, "master", images[1].Branch)
+	}
+}
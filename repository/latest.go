@@ -0,0 +1,73 @@
+package repository
+
+import "sync"
+
+// GetLatest returns the most recently modified image in the given branches of the
+// repository. If the branches have no images, a NotFoundError is returned.
+func (s *RegistryService) GetLatest(repo string, branches []string) (*Image, error) {
+	return s.getLatest(repo, branches, newLimiter(s.config.MaxConcurrency))
+}
+
+// getLatest returns the most recently modified image in the branches, fetching them
+// within the limiter
+func (s *RegistryService) getLatest(repo string, branches []string, lim limiter) (*Image, error) {
+	images, err := s.getImagesForBranches(repo, branches, lim)
+	if err != nil {
+		return nil, err
+	}
+	newest := newestImage(images, "")
+	if newest == nil {
+		return nil, &NotFoundError{}
+	}
+	return newest, nil
+}
+
+// GetLatestMany returns the most recently modified image of each repository like
+// GetLatest, fetching the repositories concurrently within RepoConcurrency and sharing
+// the MaxConcurrency limit. If some repositories could not be fetched or have no
+// images, the images of the others are returned with a RepositoriesError.
+func (s *RegistryService) GetLatestMany(repos map[string][]string) (map[string]*Image, error) {
+	lim := newLimiter(s.config.MaxConcurrency)
+	repoLim := newLimiter(s.config.RepoConcurrency)
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	latest := make(map[string]*Image, len(repos))
+	repoErrors := make(RepositoriesError)
+
+	for repo, branches := range repos {
+		waitGroup.Add(1)
+		go func(repo string, branches []string) {
+			defer waitGroup.Done()
+			repoLim.acquire()
+			defer repoLim.release()
+			image, err := s.getLatest(repo, branches, lim)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				repoErrors[repo] = err
+				return
+			}
+			latest[repo] = image
+		}(repo, branches)
+	}
+
+	waitGroup.Wait()
+	if len(repoErrors) > 0 {
+		return latest, repoErrors
+	}
+	return latest, nil
+}
+
+// newestImage returns the most recently modified of the images with a timestamp,
+// other than those tagged exclude, or nil if there are none
+func newestImage(images []*Image, exclude string) *Image {
+	var newest *Image
+	for _, image := range images {
+		if image.Tag != exclude && !image.LastModified.IsZero() &&
+			(newest == nil || image.LastModified.After(newest.LastModified)) {
+			newest = image
+		}
+	}
+	return newest
+}
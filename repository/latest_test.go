@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGetLatestMany(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": testDigest("a"),
+			"1500000200-cdef01": testDigest("b"),
+			"1500000100-bcdef0": testDigest("c"),
+		},
+		"redis": {
+			"1500000300-def012": testDigest("d"),
+		},
+		"empty": {},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, RepoConcurrency: 1}}
+	image, err := testService.GetLatest("vili", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1500000200-cdef01", image.Tag)
+	}
+
+	latest, err := testService.GetLatestMany(map[string][]string{
+		"vili":    nil,
+		"redis":   nil,
+		"empty":   nil,
+		"missing": nil,
+	})
+	if assert.IsType(t, RepositoriesError{}, err) {
+		assert.Len(t, err.(RepositoriesError), 2)
+		assert.IsType(t, &NotFoundError{}, err.(RepositoriesError)["empty"])
+		assert.Contains(t, err.(RepositoriesError), "missing")
+	}
+	if assert.Len(t, latest, 2) {
+		assert.Equal(t, "1500000200-cdef01", latest["vili"].Tag)
+		assert.Equal(t, "1500000300-def012", latest["redis"].Tag)
+	}
+}
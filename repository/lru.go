@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a concurrency-safe cache of up to size values, evicting the least
+// recently used
+type lruCache struct {
+	size int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// lruCacheEntry is a cached value and the key it is cached by
+type lruCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache returns a cache holding up to size values
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value cached by the key, marking it as recently used
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruCacheEntry).value, true
+}
+
+// add caches the value by the key, replacing any value already cached by it and
+// evicting the least recently used value if the cache is full
+func (c *lruCache) add(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruCacheEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruCacheEntry{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry).key)
+	}
+}
@@ -0,0 +1,638 @@
+package repository
+
+import (
+	// register the hash implementations for all digest algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// Manifest media types
+const (
+	MediaTypeSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeSignedSchema1 = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeSchema2       = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+)
+
+// Image config media types. Manifests whose config has another media type are
+// artifacts, such as Helm charts, rather than images.
+const (
+	MediaTypeImageConfig    = "application/vnd.docker.container.image.v1+json"
+	MediaTypeOCIImageConfig = "application/vnd.oci.image.config.v1+json"
+)
+
+// manifestMediaTypes are the manifest media types accepted when inspecting manifests
+var manifestMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeManifestList,
+	MediaTypeSchema2,
+}
+
+// schema1MediaTypes are the deprecated schema1 manifest media types, accepted if
+// AllowSchema1 is set
+var schema1MediaTypes = []string{
+	MediaTypeSignedSchema1,
+	MediaTypeSchema1,
+}
+
+// defaultMaxManifestSize is the default maximum size of a manifest body, in bytes
+const defaultMaxManifestSize = 4 << 20
+
+// defaultManifestConcurrency is the default number of concurrent manifest requests per branch
+const defaultManifestConcurrency = 5
+
+// manifest is the subset of the schema1, schema2, manifest list and OCI manifest
+// formats used by the package
+type manifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Config        *manifestDescriptor  `json:"config"`
+	Layers        []manifestDescriptor `json:"layers"`
+	Manifests     []manifestDescriptor `json:"manifests"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+	ArtifactType string            `json:"artifactType"`
+	Annotations  map[string]string `json:"annotations"`
+
+	// digest is the manifest digest reported by the registry, or computed from the
+	// manifest's content if the registry did not report it
+	digest string
+}
+
+// manifestDescriptor references a blob or manifest from a manifest
+type manifestDescriptor struct {
+	MediaType string            `json:"mediaType"`
+	Digest    string            `json:"digest"`
+	Size      int64             `json:"size"`
+	Platform  *manifestPlatform `json:"platform"`
+}
+
+// manifestPlatform is the platform of a manifest list entry
+type manifestPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// canonicalizeDigests validates the digests referenced by the manifest and rewrites
+// them in canonical form
+func (m *manifest) canonicalizeDigests() error {
+	descs := []*manifestDescriptor{m.Config}
+	for i := range m.Layers {
+		descs = append(descs, &m.Layers[i])
+	}
+	for i := range m.Manifests {
+		descs = append(descs, &m.Manifests[i])
+	}
+	for _, desc := range descs {
+		if desc == nil {
+			continue
+		}
+		dgst, err := parseDigest(desc.Digest)
+		if err != nil {
+			return err
+		}
+		desc.Digest = dgst.String()
+	}
+	for i := range m.FSLayers {
+		dgst, err := parseDigest(m.FSLayers[i].BlobSum)
+		if err != nil {
+			return err
+		}
+		m.FSLayers[i].BlobSum = dgst.String()
+	}
+	return nil
+}
+
+// parseDigest parses and validates a digest, returning it in canonical form with
+// surrounding whitespace removed and a lowercase encoding. Malformed digests are
+// rejected with an InvalidDigestError.
+func parseDigest(s string) (digest.Digest, error) {
+	dgst, err := digest.ParseDigest(strings.ToLower(strings.TrimSpace(s)))
+	if err != nil {
+		return "", &InvalidDigestError{Digest: s, Err: err}
+	}
+	return dgst, nil
+}
+
+// artifactType returns the type of the artifact the manifest holds, from its
+// artifactType field or otherwise the media type of its config, or "" if it holds an
+// image. Configs without a media type are assumed to be image configs.
+func (m *manifest) artifactType() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	if m.Config == nil {
+		return ""
+	}
+	switch m.Config.MediaType {
+	case "", MediaTypeImageConfig, MediaTypeOCIImageConfig:
+		return ""
+	}
+	return m.Config.MediaType
+}
+
+// ShortDigest returns the canonical form of the digest with its encoded part abbreviated
+// to length characters, as in sha256:0123456789ab, for display. Digests that are
+// already as short are returned in full.
+func ShortDigest(imageDigest string, length int) (string, error) {
+	dgst, err := parseDigest(imageDigest)
+	if err != nil {
+		return "", err
+	}
+	encoded := dgst.Hex()
+	if length > 0 && len(encoded) > length {
+		encoded = encoded[:length]
+	}
+	return string(dgst.Algorithm()) + ":" + encoded, nil
+}
+
+// setShortDigest populates the ShortDigest of the image if ShortDigestLength is set
+func (s *RegistryService) setShortDigest(image *Image) {
+	if s.config.ShortDigestLength <= 0 || image.Digest == "" {
+		return
+	}
+	image.ShortDigest, _ = ShortDigest(image.Digest, s.config.ShortDigestLength)
+}
+
+// isIndex returns true if the manifest is a manifest list or OCI image index
+func (m *manifest) isIndex() bool {
+	return m.MediaType == MediaTypeManifestList || m.MediaType == MediaTypeOCIIndex
+}
+
+// blobs returns the digests of the blobs referenced by an image manifest
+func (m *manifest) blobs() []string {
+	var blobs []string
+	for _, desc := range m.blobDescriptors() {
+		blobs = append(blobs, desc.Digest)
+	}
+	return blobs
+}
+
+// blobDescriptors returns the descriptors of the blobs referenced by an image manifest.
+// Schema1 manifests do not record blob sizes, so their sizes are zero.
+func (m *manifest) blobDescriptors() []manifestDescriptor {
+	var descs []manifestDescriptor
+	if m.Config != nil {
+		descs = append(descs, *m.Config)
+	}
+	descs = append(descs, m.Layers...)
+	for _, layer := range m.FSLayers {
+		descs = append(descs, manifestDescriptor{Digest: layer.BlobSum})
+	}
+	return descs
+}
+
+// acceptedMediaTypes returns the manifest media types accepted when inspecting manifests,
+// excluding those the registry was found not to support by Capabilities
+func (s *RegistryService) acceptedMediaTypes() []string {
+	mediaTypes := s.allAcceptedMediaTypes()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.unsupportedMediaTypes) == 0 {
+		return mediaTypes
+	}
+	var supported []string
+	for _, mediaType := range mediaTypes {
+		if !s.unsupportedMediaTypes[mediaType] {
+			supported = append(supported, mediaType)
+		}
+	}
+	if len(supported) == 0 {
+		return mediaTypes
+	}
+	return supported
+}
+
+// allAcceptedMediaTypes returns the manifest media types accepted by the configuration
+func (s *RegistryService) allAcceptedMediaTypes() []string {
+	if s.config.AllowSchema1 {
+		return append(append([]string{}, manifestMediaTypes...), schema1MediaTypes...)
+	}
+	return manifestMediaTypes
+}
+
+// schemaVersion returns the manifest schema version for the given media type, or 0 if unknown
+func schemaVersion(mediaType string) int {
+	switch mediaType {
+	case MediaTypeSchema1, MediaTypeSignedSchema1:
+		return 1
+	case MediaTypeSchema2, MediaTypeManifestList, MediaTypeOCIManifest, MediaTypeOCIIndex:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// headManifest issues a HEAD request for the manifest with the given tag or digest,
+// accepting all known manifest media types
+func (s *RegistryService) headManifest(httpClient *http.Client, name reference.Named, ref string) (distribution.Descriptor, error) {
+	req, err := http.NewRequest("HEAD", s.registryURL()+"/v2/"+name.Name()+"/manifests/"+ref, nil)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	for _, mediaType := range s.acceptedMediaTypes() {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return distribution.Descriptor{}, &NotFoundError{}
+	}
+	if !client.SuccessStatus(resp.StatusCode) {
+		return distribution.Descriptor{}, client.HandleErrorResponse(resp)
+	}
+
+	desc := distribution.Descriptor{Size: resp.ContentLength}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		desc.MediaType = mediaType
+	}
+	if digestHeader := resp.Header.Get("Docker-Content-Digest"); digestHeader != "" {
+		desc.Digest, err = parseDigest(digestHeader)
+		if err != nil {
+			return distribution.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// headManifestDigest issues a HEAD request for the manifest like headManifest. If the
+// registry does not send the manifest's digest, the manifest is fetched instead, and
+// its digest is computed from its content.
+func (s *RegistryService) headManifestDigest(httpClient *http.Client, name reference.Named, ref string) (distribution.Descriptor, error) {
+	desc, err := s.headManifest(httpClient, name, ref)
+	if err != nil || desc.Digest != "" {
+		return desc, err
+	}
+	m, err := s.getManifest(httpClient, name, ref)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	desc.Digest = digest.Digest(m.digest)
+	if desc.MediaType == "" {
+		desc.MediaType = m.MediaType
+	}
+	return desc, nil
+}
+
+// SameImage returns whether the two tags in the repository point at the same image.
+// Tags are compared by the digest of the manifest they reference, so tags of a
+// multi-platform image are compared by their manifest list digest. If either tag
+// does not exist, a NotFoundError is returned.
+func (s *RegistryService) SameImage(repo, tagA, tagB string) (bool, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return false, err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	descA, err := s.headManifestDigest(httpClient, repoNameRef, tagA)
+	if err != nil {
+		return false, err
+	}
+	descB, err := s.headManifestDigest(httpClient, repoNameRef, tagB)
+	if err != nil {
+		return false, err
+	}
+	return descA.Digest == descB.Digest, nil
+}
+
+// TracksNewest returns whether the moving tag, such as latest, points at the same image
+// as the most recently modified image in the given branches. If the branches have no
+// images, a NotFoundError is returned.
+func (s *RegistryService) TracksNewest(repo string, branches []string, movingTag string) (bool, error) {
+	images, err := s.GetRepository(repo, branches)
+	if err != nil {
+		return false, err
+	}
+	newest := newestImage(images, movingTag)
+	if newest == nil {
+		return false, &NotFoundError{}
+	}
+	return s.SameImage(repo, movingTag, newest.Tag)
+}
+
+// ResolveAlias resolves a floating tag, such as stable, to the concrete tag of the form
+// <unixsecs>-<sha> that points at the same image, preferring the most recently modified
+// if there are several, and returns it with the image's digest. A tag that is already
+// concrete resolves to itself. If no concrete tag points at the image, a NotFoundError
+// is returned.
+func (s *RegistryService) ResolveAlias(repo, tag string) (string, string, error) {
+	tag, err := s.resolveTag(tag)
+	if err != nil {
+		return "", "", err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return "", "", err
+	}
+	httpClient := &http.Client{Transport: transport}
+	desc, err := s.headManifestDigest(httpClient, repoNameRef, tag)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed, ok := s.splitTag(tag); ok && !parsed.lastModified.IsZero() {
+		return tag, desc.Digest.String(), nil
+	}
+
+	repository, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return "", "", err
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return "", "", err
+	}
+
+	lim := newLimiter(s.manifestConcurrency())
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	var newest string
+	var newestModified time.Time
+	errChan := make(chan error, len(tags))
+	for _, candidate := range tags {
+		parsed, ok := s.splitTag(candidate)
+		if !ok || parsed.lastModified.IsZero() {
+			continue
+		}
+		waitGroup.Add(1)
+		go func(candidate string, lastModified time.Time) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			candidateDesc, err := s.headManifestDigest(httpClient, repoNameRef, candidate)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if candidateDesc.Digest == desc.Digest && (newest == "" || lastModified.After(newestModified)) {
+				newest, newestModified = candidate, lastModified
+			}
+		}(candidate, parsed.lastModified)
+	}
+	waitGroup.Wait()
+	close(errChan)
+
+	if err := <-errChan; err != nil {
+		return "", "", err
+	}
+	if newest == "" {
+		return "", "", &NotFoundError{}
+	}
+	return newest, desc.Digest.String(), nil
+}
+
+// Exists returns whether the tag exists in the repository. If the repository itself
+// is not known to the registry, an error wrapping ErrRepositoryUnknown is returned.
+// A tag missing from a known repository is looked up in the PrimaryURL registry, if set.
+func (s *RegistryService) Exists(repo, tag string) (bool, error) {
+	return s.ExistsContext(context.Background(), repo, tag)
+}
+
+// ExistsMany returns whether each of the tags exists in the repository, checking
+// them concurrently. Tags that could not be checked are omitted from the result,
+// and returned in a TagsError along with the results for the other tags.
+func (s *RegistryService) ExistsMany(repo string, tags []string) (map[string]bool, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport}
+	lim := newLimiter(s.manifestConcurrency())
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	exists := make(map[string]bool, len(tags))
+	tagErrors := make(TagsError)
+	for _, tag := range tags {
+		waitGroup.Add(1)
+		go func(tag string) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			_, err := s.headManifest(httpClient, repoNameRef, tag)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch err.(type) {
+			case nil:
+				exists[tag] = true
+				s.markRepositoryKnown(repo)
+			case *NotFoundError:
+				exists[tag] = false
+			default:
+				tagErrors[tag] = err
+			}
+		}(tag)
+	}
+	waitGroup.Wait()
+
+	if len(tagErrors) > 0 {
+		return exists, tagErrors
+	}
+	return exists, nil
+}
+
+// manifestConcurrency returns the maximum number of concurrent manifest requests per operation
+func (s *RegistryService) manifestConcurrency() int {
+	if s.config.ManifestConcurrency > 0 {
+		return s.config.ManifestConcurrency
+	}
+	return defaultManifestConcurrency
+}
+
+// maxManifestSize returns the maximum size of a manifest body, in bytes
+func (s *RegistryService) maxManifestSize() int64 {
+	if s.config.MaxManifestSize > 0 {
+		return s.config.MaxManifestSize
+	}
+	return defaultMaxManifestSize
+}
+
+// setManifestInfo populates the manifest digest, media type and schema version of the
+// images. With PlatformDigests, manifest lists are resolved to their DefaultPlatform
+// image, and images whose list has no such image are dropped.
+func (s *RegistryService) setManifestInfo(images []*Image, name reference.Named, transport http.RoundTripper) ([]*Image, error) {
+	lim := newLimiter(s.manifestConcurrency())
+	httpClient := &http.Client{Transport: transport}
+
+	var waitGroup sync.WaitGroup
+	errChan := make(chan error, len(images))
+	missing := make([]bool, len(images))
+	for i, image := range images {
+		waitGroup.Add(1)
+		go func(i int, image *Image) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			desc, err := s.headManifestDigest(httpClient, name, image.Tag)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			image.Digest = desc.Digest.String()
+			image.MediaType = desc.MediaType
+			if s.config.PlatformDigests && (desc.MediaType == MediaTypeManifestList || desc.MediaType == MediaTypeOCIIndex) {
+				found, err := s.setPlatformDigest(httpClient, name, image)
+				if err != nil {
+					errChan <- err
+					return
+				}
+				missing[i] = !found
+			}
+			image.SchemaVersion = schemaVersion(image.MediaType)
+			s.setShortDigest(image)
+		}(i, image)
+	}
+	waitGroup.Wait()
+	close(errChan)
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
+	filtered := images[:0]
+	for i, image := range images {
+		if !missing[i] {
+			filtered = append(filtered, image)
+		}
+	}
+	return filtered, nil
+}
+
+// setPlatformDigest replaces the manifest list digest and media type of the image with
+// those of the list's DefaultPlatform image, keeping the list digest in IndexDigest. It
+// returns false if the list has no image for the platform.
+func (s *RegistryService) setPlatformDigest(httpClient *http.Client, name reference.Named, image *Image) (bool, error) {
+	platform, err := s.defaultPlatform()
+	if err != nil {
+		return false, err
+	}
+	m, err := s.getManifest(httpClient, name, image.Digest)
+	if err != nil {
+		return false, err
+	}
+	for _, child := range m.Manifests {
+		if child.Platform != nil && *child.Platform == platform {
+			image.IndexDigest = image.Digest
+			image.Digest = child.Digest
+			image.MediaType = child.MediaType
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getManifest fetches and parses the manifest with the given tag or digest
+func (s *RegistryService) getManifest(httpClient *http.Client, name reference.Named, ref string) (*manifest, error) {
+	req, err := http.NewRequest("GET", s.registryURL()+"/v2/"+name.Name()+"/manifests/"+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mediaType := range s.acceptedMediaTypes() {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return nil, client.HandleErrorResponse(resp)
+	}
+
+	maxSize := s.maxManifestSize()
+	if resp.ContentLength > maxSize {
+		return nil, &ManifestTooLargeError{Limit: maxSize}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, &ManifestTooLargeError{Limit: maxSize}
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType != "application/json" {
+		m.MediaType = mediaType
+	}
+	if digestHeader := resp.Header.Get("Docker-Content-Digest"); digestHeader != "" {
+		dgst, err := parseDigest(digestHeader)
+		if err != nil {
+			return nil, err
+		}
+		m.digest = dgst.String()
+	} else {
+		m.digest = digest.FromBytes(body).String()
+	}
+	if err := m.canonicalizeDigests(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// getManifestBlobs returns the digests of the blobs referenced by the manifest with the
+// given tag or digest. For manifest lists, these are the child manifests and their blobs.
+func (s *RegistryService) getManifestBlobs(httpClient *http.Client, name reference.Named, ref string) ([]string, error) {
+	descs, err := s.getManifestDescriptors(httpClient, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []string
+	for _, desc := range descs {
+		blobs = append(blobs, desc.Digest)
+	}
+	return blobs, nil
+}
+
+// getManifestDescriptors returns the descriptors of the blobs referenced by the manifest
+// with the given tag or digest. For manifest lists, these are the child manifests and
+// their blobs.
+func (s *RegistryService) getManifestDescriptors(httpClient *http.Client, name reference.Named, ref string) ([]manifestDescriptor, error) {
+	m, err := s.getManifest(httpClient, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	if !m.isIndex() {
+		return m.blobDescriptors(), nil
+	}
+	var descs []manifestDescriptor
+	for _, child := range m.Manifests {
+		childManifest, err := s.getManifest(httpClient, name, child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, child)
+		descs = append(descs, childManifest.blobDescriptors()...)
+	}
+	return descs, nil
+}
@@ -0,0 +1,421 @@
+package repository
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryFetchManifestInfo(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:             server.URL,
+			FetchManifestInfo:   true,
+			ManifestConcurrency: 1,
+		},
+	}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	for _, image := range images {
+		assert.Equal(t, MediaTypeSchema2, image.MediaType)
+		assert.Equal(t, 2, image.SchemaVersion)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	assert.Equal(t, 1, schemaVersion(MediaTypeSignedSchema1))
+	assert.Equal(t, 2, schemaVersion(MediaTypeOCIManifest))
+	assert.Equal(t, 0, schemaVersion("application/json"))
+}
+
+func TestRegistryDedupe(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef":  "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"develop-1500000100-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"develop-1500000000-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:          server.URL,
+			BranchPrefixTags: true,
+			Dedupe:           true,
+		},
+	}
+	images, err := testService.GetRepository("vili", []string{"master", "develop"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "develop-1500000100-abcdef", images[0].Tag)
+	assert.Equal(t, []string{"develop", "master"}, images[0].Branches)
+	assert.Equal(t, []string{"develop"}, images[1].Branches)
+}
+
+func TestRegistrySHA512Digests(t *testing.T) {
+	sha512Digest := digest.SHA512.FromBytes([]byte("vili")).String()
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": sha512Digest},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:        server.URL,
+			ResolveDigests: true,
+		},
+	}
+	tagDigest, err := testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, sha512Digest, tagDigest)
+
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, sha512Digest, images[0].Digest)
+
+	fullName, err := testService.FullNameByDigest("vili", sha512Digest)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://")+"/vili@"+sha512Digest, fullName)
+
+	_, err = testService.FullNameByDigest("vili", "sha512:abcdef")
+	assert.Error(t, err)
+}
+
+func TestRegistrySameImage(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000100-bcdef0": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000200-cdef01": "sha256:0d8a0a7302f5fa0c6ee36f460eb7784eb0a5cd4e4a51c9e7444a7b5ab0b0a3f3",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	same, err := testService.SameImage("vili", "1500000000-abcdef", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.True(t, same)
+
+	same, err = testService.SameImage("vili", "1500000000-abcdef", "1500000200-cdef01")
+	assert.NoError(t, err)
+	assert.False(t, same)
+
+	_, err = testService.SameImage("vili", "1500000000-abcdef", "missing")
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestRegistrySameImageWithoutDigestHeader(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a"), "1500000100-bcdef0": testDigest("b"), "1500000200-cdef01": testDigest("a")},
+	}}
+	reg.manifests = map[string]string{
+		"1500000000-abcdef": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"1500000100-bcdef0": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c1") + `"}}`,
+		"1500000200-cdef01": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Content-Type", MediaTypeSchema2)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	same, err := testService.SameImage("vili", "1500000000-abcdef", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.False(t, same)
+
+	same, err = testService.SameImage("vili", "1500000000-abcdef", "1500000200-cdef01")
+	assert.NoError(t, err)
+	assert.True(t, same)
+}
+
+func TestRegistryResolveAlias(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"stable":            testDigest("b"),
+			"v2.3":              testDigest("b"),
+			"1500000000-aaaaaa": testDigest("a"),
+			"1500000001-bbbbbb": testDigest("b"),
+			"1500000002-bbbbbb": testDigest("b"),
+			"1500000003-cccccc": testDigest("c"),
+			"orphan":            testDigest("d"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	tag, dgst, err := testService.ResolveAlias("vili", "stable")
+	assert.NoError(t, err)
+	assert.Equal(t, "1500000002-bbbbbb", tag)
+	assert.Equal(t, testDigest("b"), dgst)
+
+	tag, dgst, err = testService.ResolveAlias("vili", "1500000000-aaaaaa")
+	assert.NoError(t, err)
+	assert.Equal(t, "1500000000-aaaaaa", tag)
+	assert.Equal(t, testDigest("a"), dgst)
+
+	_, _, err = testService.ResolveAlias("vili", "orphan")
+	assert.IsType(t, &NotFoundError{}, err)
+}
+
+func TestRegistryExistsMany(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"invalid":           "invalid",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	exists, err := testService.ExistsMany("vili", []string{"1500000000-abcdef", "1500000100-bcdef0", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"1500000000-abcdef": true, "1500000100-bcdef0": true, "missing": false}, exists)
+
+	exists, err = testService.ExistsMany("vili", []string{"1500000000-abcdef", "invalid"})
+	assert.IsType(t, TagsError{}, err)
+	assert.Contains(t, err.(TagsError), "invalid")
+	assert.Equal(t, map[string]bool{"1500000000-abcdef": true}, exists)
+
+	found, err := testService.Exists("vili", "missing")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestRegistryMaxManifestSize(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"small": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}}`,
+		"large": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest("c0") + `"}, "layers": [` +
+			strings.Repeat(`{"digest": "`+testDigest("l0")+`", "size": 1},`, 10) + `{"digest": "` + testDigest("l0") + `", "size": 1}]}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, MaxManifestSize: 200}}
+	name, transport, err := testService.getRepositoryTransport("vili")
+	assert.NoError(t, err)
+	httpClient := &http.Client{Transport: transport}
+	_, err = testService.getManifest(httpClient, name, "small")
+	assert.NoError(t, err)
+	_, err = testService.getManifest(httpClient, name, "large")
+	assert.Equal(t, &ManifestTooLargeError{Limit: 200}, err)
+}
+
+func TestRegistryTracksNewest(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"latest":            "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	tracks, err := testService.TracksNewest("vili", []string{"master"}, "latest")
+	assert.NoError(t, err)
+	assert.True(t, tracks)
+
+	reg.tags["vili"]["latest"] = "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"
+	tracks, err = testService.TracksNewest("vili", []string{"master"}, "latest")
+	assert.NoError(t, err)
+	assert.False(t, tracks)
+}
+
+func TestRegistryCanonicalDigests(t *testing.T) {
+	canonical := "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": "sha256:F0A2BD2FD3E61E2B1CA6BA6DDBA4A9BB7B9A47D4E6D0C2E0A9AC28D7A2A1E54C"},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ResolveDigests: true}}
+	tagDigest, err := testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, canonical, tagDigest)
+
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Equal(t, canonical, images[0].Digest)
+
+	fullName, err := testService.FullNameByDigest("vili", " "+strings.ToUpper(canonical)+"\n")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(fullName, "@"+canonical))
+
+	_, err = testService.FullNameByDigest("vili", "md5:abcdef")
+	assert.IsType(t, &InvalidDigestError{}, err)
+}
+
+func TestRegistryPrimaryURL(t *testing.T) {
+	_, replica := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a")},
+	})
+	defer replica.Close()
+	primaryReg, primary := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a"), "1500000100-bcdef0": testDigest("b")},
+	})
+	defer primary.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: replica.URL, PrimaryURL: primary.URL}}
+	digest, err := testService.GetTag("vili", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("b"), digest)
+	exists, err := testService.Exists("vili", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = testService.GetTag("vili", "missing")
+	assert.True(t, errors.Is(err, ErrTagUnknown), "%v", err)
+	exists, err = testService.Exists("vili", "missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// unknown repositories are not looked up in the primary
+	primaryReg.mutex.Lock()
+	primaryRequests := len(primaryReg.requests)
+	primaryReg.mutex.Unlock()
+	_, err = testService.Exists("typo", "1500000000-abcdef")
+	assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+	primaryReg.mutex.Lock()
+	assert.Len(t, primaryReg.requests, primaryRequests)
+	primaryReg.mutex.Unlock()
+}
+
+func TestRegistryHedgeDelay(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a")},
+	}}
+	var slow int32
+	cancelled := make(chan bool, 1)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 && strings.Contains(r.URL.Path, "/manifests/") {
+			select {
+			case <-r.Context().Done():
+				cancelled <- true
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer replica.Close()
+	primaryReg, primary := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a"), "1500000100-bcdef0": testDigest("b")},
+	})
+	defer primary.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:    replica.URL,
+		PrimaryURL: primary.URL,
+		HedgeDelay: 50 * time.Millisecond,
+	}}
+	digest, err := testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("a"), digest)
+	primaryReg.mutex.Lock()
+	for _, req := range primaryReg.requests {
+		assert.NotContains(t, req.URL.Path, "/manifests/")
+	}
+	primaryReg.mutex.Unlock()
+
+	// tags missing from the replica are looked up in the primary without waiting
+	digest, err = testService.GetTag("vili", "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("b"), digest)
+	_, err = testService.GetTag("vili", "missing")
+	assert.True(t, errors.Is(err, ErrTagUnknown), "%v", err)
+
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	digest, err = testService.GetTag("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest("a"), digest)
+	assert.True(t, time.Since(start) < time.Second)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the replica request was not cancelled")
+	}
+}
+
+func TestRegistryPlatformDigests(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": testDigest("list"),
+			"1500000100-bcdef0": testDigest("amd64-only"),
+			"1500000200-cdef01": testDigest("image"),
+		},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		testDigest("list"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"mediaType": "` + MediaTypeSchema2 + `", "digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"mediaType": "` + MediaTypeSchema2 + `", "digest": "` + testDigest("arm64") + `", "platform": {"os": "linux", "architecture": "arm64"}}]}`,
+		testDigest("amd64-only"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"mediaType": "` + MediaTypeSchema2 + `", "digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:         server.URL,
+		ResolveDigests:  true,
+		PlatformDigests: true,
+		DefaultPlatform: "linux/arm64",
+	}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, "1500000200-cdef01", images[0].Tag)
+		assert.Equal(t, testDigest("image"), images[0].Digest)
+		assert.Equal(t, "", images[0].IndexDigest)
+		assert.Equal(t, "1500000000-abcdef", images[1].Tag)
+		assert.Equal(t, testDigest("arm64"), images[1].Digest)
+		assert.Equal(t, testDigest("list"), images[1].IndexDigest)
+		assert.Equal(t, MediaTypeSchema2, images[1].MediaType)
+	}
+}
+
+func TestShortDigest(t *testing.T) {
+	imageDigest := testDigest("vili")
+	short, err := ShortDigest(strings.ToUpper(imageDigest), 12)
+	assert.NoError(t, err)
+	assert.Equal(t, imageDigest[:len("sha256:")+12], short)
+	short, err = ShortDigest(imageDigest, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, imageDigest, short)
+	_, err = ShortDigest("sha256:abc", 12)
+	assert.IsType(t, &InvalidDigestError{}, err)
+
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"1500000000-abcdef": imageDigest},
+	})
+	defer server.Close()
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ResolveDigests: true, ShortDigestLength: 12}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, imageDigest, images[0].Digest)
+		assert.Equal(t, imageDigest[:len("sha256:")+12], images[0].ShortDigest)
+	}
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/client"
+)
+
+// TagStatus is the presence of a tag in the registry
+type TagStatus int
+
+// Tag statuses
+const (
+	// TagMissing indicates that the tag does not exist, including upstream
+	TagMissing TagStatus = iota
+	// TagUpstream indicates that the tag exists upstream of a pull-through cache,
+	// but is not cached locally
+	TagUpstream
+	// TagCached indicates that the tag exists in the registry
+	TagCached
+)
+
+// GetTagStatus returns the presence of the tag in the repository. For pull-through
+// caches, tags missing from the local tag listing are looked up through the cache,
+// which consults the upstream registry, to tell uncached tags from missing ones.
+func (s *RegistryService) GetTagStatus(repo, tag string) (TagStatus, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return TagMissing, err
+	}
+
+	if s.config.ProxyCache {
+		repository, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
+		if err != nil {
+			return TagMissing, err
+		}
+		tags, err := listTags(repository)
+		if err != nil {
+			return TagMissing, err
+		}
+		for _, cachedTag := range tags {
+			if cachedTag == tag {
+				return TagCached, nil
+			}
+		}
+	}
+
+	_, err = s.headManifest(&http.Client{Transport: transport}, repoNameRef, tag)
+	switch err.(type) {
+	case nil:
+		if s.config.ProxyCache {
+			return TagUpstream, nil
+		}
+		return TagCached, nil
+	case *NotFoundError:
+		return TagMissing, nil
+	default:
+		return TagMissing, err
+	}
+}
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGetTagStatus(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"library/redis": {"4.0": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+	reg.upstreamTags = map[string]string{
+		"5.0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ProxyCache: true}}
+	for tag, expected := range map[string]TagStatus{
+		"4.0": TagCached,
+		"5.0": TagUpstream,
+		"6.0": TagMissing,
+	} {
+		status, err := testService.GetTagStatus("library/redis", tag)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, status, tag)
+	}
+
+	testService.config.ProxyCache = false
+	status, err := testService.GetTagStatus("library/redis", "5.0")
+	assert.NoError(t, err)
+	assert.Equal(t, TagCached, status)
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/client"
+)
+
+// Components of an image checked by VerifyPullable
+const (
+	ComponentTag      = "tag"
+	ComponentManifest = "manifest"
+	ComponentConfig   = "config"
+	ComponentLayer    = "layer"
+)
+
+// MissingComponentError is raised by VerifyPullable when a component of an image is
+// missing from the registry. Digest is empty for a missing tag.
+type MissingComponentError struct {
+	Repo      string
+	Tag       string
+	Component string
+	Digest    string
+}
+
+func (e *MissingComponentError) Error() string {
+	if e.Digest == "" {
+		return fmt.Sprintf("Image %s:%s is missing its %s", e.Repo, e.Tag, e.Component)
+	}
+	return fmt.Sprintf("Image %s:%s is missing its %s %s", e.Repo, e.Tag, e.Component, e.Digest)
+}
+
+// VerifyPullable checks that the image with the given tag can be pulled: that the tag
+// resolves to a manifest and that every blob the manifest references, its config and
+// layers, exists in the registry. Manifest lists are resolved to the image for the
+// DefaultPlatform as in GetImageDetails. A MissingComponentError identifies the first
+// missing component.
+func (s *RegistryService) VerifyPullable(repo, tag string) error {
+	tag, err := s.resolveTag(tag)
+	if err != nil {
+		return err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	m, err := s.getManifest(httpClient, repoNameRef, tag)
+	if err != nil {
+		if isNotFound(unknownError(err)) {
+			return &MissingComponentError{Repo: repo, Tag: tag, Component: ComponentTag}
+		}
+		return err
+	}
+	if m.isIndex() {
+		child, err := s.platformManifest(m, repoNameRef.Name(), tag)
+		if err != nil {
+			return err
+		}
+		if m, err = s.getManifest(httpClient, repoNameRef, child.Digest); err != nil {
+			if isNotFound(unknownError(err)) {
+				return &MissingComponentError{Repo: repo, Tag: tag, Component: ComponentManifest, Digest: child.Digest}
+			}
+			return err
+		}
+	}
+
+	repository, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return err
+	}
+	blobs := repository.Blobs(context.Background())
+	for _, desc := range m.blobDescriptors() {
+		dgst, err := parseDigest(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err := blobs.Stat(context.Background(), dgst); err == distribution.ErrBlobUnknown {
+			component := ComponentLayer
+			if m.Config != nil && desc.Digest == m.Config.Digest {
+				component = ComponentConfig
+			}
+			return &MissingComponentError{Repo: repo, Tag: tag, Component: component, Digest: dgst.String()}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
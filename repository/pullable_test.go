@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryVerifyPullable(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{})
+	defer server.Close()
+	image := func(config string, layers ...string) string {
+		body := `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `", "config": {"digest": "` + testDigest(config) + `"}, "layers": [`
+		for i, layer := range layers {
+			if i > 0 {
+				body += ", "
+			}
+			body += `{"digest": "` + testDigest(layer) + `"}`
+		}
+		return body + `]}`
+	}
+	reg.manifests = map[string]string{
+		"complete":       image("c0", "l0", "l1"),
+		"missing-config": image("c1", "l0"),
+		"missing-layer":  image("c0", "l0", "l2"),
+		"list": `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"digest": "` + testDigest("arm64") + `", "platform": {"os": "linux", "architecture": "arm64"}},
+			{"digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+		testDigest("arm64"): image("c0", "l0"),
+	}
+	reg.blobs = map[string]bool{
+		testDigest("c0"): true,
+		testDigest("l0"): true,
+		testDigest("l1"): true,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	assert.NoError(t, testService.VerifyPullable("vili", "complete"))
+	for tag, expected := range map[string]*MissingComponentError{
+		"missing":        {Component: ComponentTag},
+		"missing-config": {Component: ComponentConfig, Digest: testDigest("c1")},
+		"missing-layer":  {Component: ComponentLayer, Digest: testDigest("l2")},
+		"list":           {Component: ComponentManifest, Digest: testDigest("amd64")},
+	} {
+		expected.Repo, expected.Tag = "vili", tag
+		assert.Equal(t, expected, testService.VerifyPullable("vili", tag), tag)
+	}
+
+	testService.config.DefaultPlatform = "linux/arm64"
+	assert.NoError(t, testService.VerifyPullable("vili", "list"))
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/registry/client"
+)
+
+// PlatformManifest is a platform-specific image manifest referenced by a manifest list
+type PlatformManifest struct {
+	// Digest is the digest of the image manifest in the repository
+	Digest       string
+	Architecture string
+	OS           string
+	Variant      string
+}
+
+// PushManifestList assembles a manifest list from the given platform-specific image
+// manifests and pushes it to the repository with the given tag. Each manifest must
+// already exist in the repository and must not itself be a manifest list.
+func (s *RegistryService) PushManifestList(repo, tag string, entries []PlatformManifest) error {
+	if len(entries) == 0 {
+		return fmt.Errorf("manifest list %s:%s has no manifests", repo, tag)
+	}
+	repoNameRef, transport, err := s.getPushTransport(repo)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	descriptors := make([]manifestlist.ManifestDescriptor, 0, len(entries))
+	for _, entry := range entries {
+		dgst, err := parseDigest(entry.Digest)
+		if err != nil {
+			return err
+		}
+		desc, err := s.headManifest(httpClient, repoNameRef, dgst.String())
+		if _, ok := err.(*NotFoundError); ok {
+			return fmt.Errorf("manifest %s does not exist in %s", dgst, repo)
+		} else if err != nil {
+			return err
+		}
+		switch desc.MediaType {
+		case MediaTypeManifestList, MediaTypeOCIIndex:
+			return fmt.Errorf("manifest %s is a manifest list", dgst)
+		}
+		desc.Digest = dgst
+		descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+			Descriptor: desc,
+			Platform: manifestlist.PlatformSpec{
+				Architecture: entry.Architecture,
+				OS:           entry.OS,
+				Variant:      entry.Variant,
+			},
+		})
+	}
+
+	list, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		return err
+	}
+	repository, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return err
+	}
+	manifests, err := repository.Manifests(context.Background())
+	if err != nil {
+		return err
+	}
+	_, err = manifests.Put(context.Background(), list, distribution.WithTag(tag))
+	return err
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryPushManifestList(t *testing.T) {
+	amd64Digest, arm64Digest := testDigest("amd64"), testDigest("arm64")
+	reg, server := newTestRegistry(map[string]map[string]string{
+		// manifests are addressable by digest
+		"vili": {amd64Digest: amd64Digest, arm64Digest: arm64Digest},
+	})
+	defer server.Close()
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Username: "user", Password: "pass"}}
+	err := testService.PushManifestList("vili", "1500000000-abcdef", []PlatformManifest{
+		{Digest: amd64Digest, Architecture: "amd64", OS: "linux"},
+		{Digest: arm64Digest, Architecture: "arm64", OS: "linux", Variant: "v8"},
+	})
+	assert.NoError(t, err)
+
+	var pushed manifest
+	assert.NoError(t, json.Unmarshal([]byte(reg.manifests["1500000000-abcdef"]), &pushed))
+	assert.Equal(t, MediaTypeManifestList, pushed.MediaType)
+	if assert.Len(t, pushed.Manifests, 2) {
+		assert.Equal(t, amd64Digest, pushed.Manifests[0].Digest)
+		assert.Equal(t, MediaTypeSchema2, pushed.Manifests[0].MediaType)
+		assert.Equal(t, &manifestPlatform{Architecture: "arm64", OS: "linux"}, pushed.Manifests[1].Platform)
+	}
+
+	err = testService.PushManifestList("vili", "latest", []PlatformManifest{
+		{Digest: testDigest("missing"), Architecture: "amd64", OS: "linux"},
+	})
+	assert.EqualError(t, err, "manifest "+testDigest("missing")+" does not exist in vili")
+	_, ok := reg.manifests["latest"]
+	assert.False(t, ok)
+}
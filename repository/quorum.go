@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// branchQuorum cancels the branch fetches still outstanding once enough branches
+// have been fetched successfully
+type branchQuorum struct {
+	mutex  sync.Mutex
+	needed int
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newBranchQuorum returns a quorum of needed of the branches, or nil if every branch
+// is needed
+func newBranchQuorum(needed, branches int) *branchQuorum {
+	if needed <= 0 || needed >= branches {
+		return nil
+	}
+	return &branchQuorum{needed: needed}
+}
+
+// attach makes the branch fetches of the deadlines cancellable by the quorum. If there
+// are no deadlines, deadlines without a deadline are returned.
+func (q *branchQuorum) attach(deadlines *branchDeadlines) *branchDeadlines {
+	if q == nil {
+		return deadlines
+	}
+	if deadlines == nil {
+		deadlines = &branchDeadlines{ctx: context.Background()}
+	}
+	q.ctx, q.cancel = context.WithCancel(deadlines.ctx)
+	deadlines.ctx = q.ctx
+	return deadlines
+}
+
+// succeeded records a successful branch fetch, cancelling the outstanding fetches if
+// it completes the quorum
+func (q *branchQuorum) succeeded() {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.needed--
+	if q.needed == 0 {
+		q.cancel()
+	}
+}
+
+// reached returns whether the quorum has been reached
+func (q *branchQuorum) reached() bool {
+	if q == nil {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.needed <= 0
+}
+
+// release releases the quorum's context once the fetches are done
+func (q *branchQuorum) release() {
+	if q != nil {
+		q.cancel()
+	}
+}
+
+// outstanding returns whether a branch fetch that failed with err was cancelled
+// because the quorum was reached
+func (q *branchQuorum) outstanding(err error) bool {
+	return q.reached() && errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryMinBranchesSuccess(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {
+			"master-1500000100-bcdef0":  testDigest("a"),
+			"develop-1500000200-cdef01": testDigest("b"),
+			"feature-1500000300-def012": testDigest("c"),
+		},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/feature-") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:            server.URL,
+		BranchPrefixTags:   true,
+		FetchManifestInfo:  true,
+		MinBranchesSuccess: 2,
+		ErrorPolicy:        FailOnAny,
+	}}
+	start := time.Now()
+	result, err := testService.GetRepositoryDetailed("vili", []string{"feature", "develop", "master"})
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"feature"}, result.Outstanding)
+	assert.True(t, result.Branches["feature"].Outstanding)
+	assert.NoError(t, result.Branches["feature"].Err)
+	assert.False(t, result.Branches["master"].Outstanding)
+	assert.Len(t, result.Images, 2)
+
+	images, err := testService.GetRepository("vili", []string{"develop", "master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+}
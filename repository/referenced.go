@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// IsDigestReferenced returns whether any tag in the repository resolves to the manifest
+// digest, or to a manifest list or index containing it, as a guard before deleting the
+// manifest
+func (s *RegistryService) IsDigestReferenced(repo, manifestDigest string) (bool, error) {
+	return s.IsDigestReferencedContext(context.Background(), repo, manifestDigest)
+}
+
+// IsDigestReferencedContext is IsDigestReferenced with a context. The tags are
+// resolved concurrently, and the remaining requests are cancelled as soon as a tag
+// resolving to the digest is found. Tags deleted while they are resolved are ignored.
+func (s *RegistryService) IsDigestReferencedContext(ctx context.Context, repo, manifestDigest string) (bool, error) {
+	tags, err := s.tagsReferencing(ctx, repo, manifestDigest, true)
+	if len(tags) > 0 {
+		return true, nil
+	}
+	return false, err
+}
+
+// ReferencesOf returns the images of every tag in the repository that resolves to the
+// manifest digest, or to a manifest list or index containing it, sorted by branch and
+// then tag. Tags are attributed to branches by the tag parser, and tags that don't
+// parse, such as latest, are returned without a branch or revision.
+func (s *RegistryService) ReferencesOf(repo, manifestDigest string) ([]*Image, error) {
+	return s.ReferencesOfContext(context.Background(), repo, manifestDigest)
+}
+
+// ReferencesOfContext is ReferencesOf with a context. The tags are resolved
+// concurrently, ManifestConcurrency at a time. Tags that could not be resolved are
+// returned in a TagsError along with the images of the other tags.
+func (s *RegistryService) ReferencesOfContext(ctx context.Context, repo, manifestDigest string) ([]*Image, error) {
+	tags, err := s.tagsReferencing(ctx, repo, manifestDigest, false)
+	if _, ok := err.(TagsError); err != nil && !ok {
+		return nil, err
+	}
+	dgst, _ := parseDigest(manifestDigest)
+	var images []*Image
+	for _, tag := range tags {
+		var image *Image
+		if parsed, ok := s.splitTag(tag); ok && s.config.BranchPrefixTags {
+			image, _ = s.parseTag(tag, parsed.branch)
+		} else if ok {
+			image, _ = s.parseTag(tag, "")
+		}
+		if image == nil {
+			image = &Image{Registry: s.pullDomain(), Tag: tag}
+		}
+		image.Digest = dgst.String()
+		s.setShortDigest(image)
+		images = append(images, image)
+	}
+	sortByBranchAndTag(images)
+	return images, err
+}
+
+// tagsReferencing returns the tags of the repository that resolve to the manifest
+// digest or to an index containing it, resolving them concurrently. If first is set,
+// the remaining requests are cancelled once a tag is found. Tags deleted while they
+// are resolved are ignored, and tags that could not be resolved are returned in a
+// TagsError.
+func (s *RegistryService) tagsReferencing(ctx context.Context, repo, manifestDigest string, first bool) ([]string, error) {
+	dgst, err := parseDigest(manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	transport = &contextTransport{base: transport, ctx: ctx}
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Transport: transport}
+	lim := newLimiter(s.manifestConcurrency())
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	var referencing []string
+	tagErrors := make(TagsError)
+	for _, tag := range tags {
+		waitGroup.Add(1)
+		go func(tag string) {
+			defer waitGroup.Done()
+			lim.acquire()
+			defer lim.release()
+			referenced, err := s.tagReferences(ctx, httpClient, repoNameRef, tag, dgst.String())
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch err.(type) {
+			case nil:
+				if referenced {
+					referencing = append(referencing, tag)
+					if first {
+						cancel()
+					}
+				}
+			case *NotFoundError:
+			default:
+				tagErrors[tag] = err
+			}
+		}(tag)
+	}
+	waitGroup.Wait()
+
+	sort.Strings(referencing)
+	if len(tagErrors) == 0 || (first && len(referencing) > 0) {
+		return referencing, nil
+	}
+	return referencing, tagErrors
+}
+
+// tagReferences returns whether the tag resolves to the manifest digest or to a
+// manifest list or index with the digest among its images
+func (s *RegistryService) tagReferences(ctx context.Context, httpClient *http.Client, name reference.Named, tag, manifestDigest string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	desc, err := s.headManifestDigest(httpClient, name, tag)
+	if err != nil {
+		return false, err
+	}
+	if desc.Digest.String() == manifestDigest {
+		return true, nil
+	}
+	if desc.MediaType != MediaTypeManifestList && desc.MediaType != MediaTypeOCIIndex {
+		return false, nil
+	}
+	m, err := s.getManifest(httpClient, name, desc.Digest.String())
+	if isNotFound(unknownError(err)) {
+		return false, &NotFoundError{}
+	} else if err != nil {
+		return false, err
+	}
+	for _, child := range m.Manifests {
+		if child.Digest == manifestDigest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryIsDigestReferenced(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": testDigest("a"),
+			"1500000100-bcdef0": testDigest("b"),
+			"1500000200-cdef01": testDigest("list"),
+			"latest":            testDigest("b"),
+		},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		testDigest("list"): `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+			{"digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ManifestConcurrency: 1}}
+	referenced, err := testService.IsDigestReferenced("vili", testDigest("b"))
+	assert.NoError(t, err)
+	assert.True(t, referenced)
+	referenced, err = testService.IsDigestReferenced("vili", testDigest("c"))
+	assert.NoError(t, err)
+	assert.False(t, referenced)
+
+	// images of a tagged manifest list are referenced through it
+	referenced, err = testService.IsDigestReferenced("vili", testDigest("amd64"))
+	assert.NoError(t, err)
+	assert.True(t, referenced)
+
+	_, err = testService.IsDigestReferenced("vili", "latest")
+	assert.IsType(t, &InvalidDigestError{}, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = testService.IsDigestReferencedContext(ctx, "vili", testDigest("b"))
+	assert.Error(t, err)
+}
+
+func TestRegistryIsDigestReferencedIndexes(t *testing.T) {
+	list := `{"schemaVersion": 2, "mediaType": "` + MediaTypeManifestList + `", "manifests": [
+		{"digest": "` + testDigest("amd64") + `", "platform": {"os": "linux", "architecture": "amd64"}}]}`
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest(list), "1500000100-bcdef0": testDigest("b")},
+	}}
+	reg.manifests = map[string]string{"1500000000-abcdef": list, testDigest(list): list}
+	var failIndex int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/manifests/1500000000-abcdef") {
+			if r.Method == "HEAD" {
+				// no Docker-Content-Digest header
+				w.Header().Set("Content-Type", MediaTypeManifestList)
+				return
+			}
+			if atomic.LoadInt32(&failIndex) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	referenced, err := testService.IsDigestReferenced("vili", testDigest("amd64"))
+	assert.NoError(t, err)
+	assert.True(t, referenced)
+
+	// an index that can't be fetched may still reference the digest
+	atomic.StoreInt32(&failIndex, 1)
+	referenced, err = testService.IsDigestReferenced("vili", testDigest("amd64"))
+	assert.IsType(t, TagsError{}, err)
+	assert.False(t, referenced)
+
+	referenced, err = testService.IsDigestReferenced("vili", testDigest("b"))
+	assert.NoError(t, err)
+	assert.True(t, referenced)
+}
+
+func TestRegistryReferencesOf(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef":  testDigest("a"),
+			"feature-1500000100-bcdef0": testDigest("b"),
+			"master-1500000100-bcdef0":  testDigest("b"),
+			"latest":                    testDigest("b"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, BranchPrefixTags: true}}
+	images, err := testService.ReferencesOf("vili", testDigest("b"))
+	assert.NoError(t, err)
+	var references []string
+	for _, image := range images {
+		assert.Equal(t, testDigest("b"), image.Digest)
+		references = append(references, image.Branch+" "+image.Tag+" "+image.Revision)
+	}
+	assert.Equal(t, []string{
+		" latest ",
+		"feature feature-1500000100-bcdef0 bcdef0",
+		"master master-1500000100-bcdef0 bcdef0",
+	}, references)
+
+	images, err = testService.ReferencesOf("vili", testDigest("c"))
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+}
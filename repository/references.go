@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"github.com/docker/distribution/reference"
+)
+
+// referenceCache is a concurrency-safe LRU cache of parsed repository references,
+// keyed by the repository name they were parsed from
+type referenceCache struct {
+	cache *lruCache
+}
+
+// newReferenceCache returns a cache holding up to size references
+func newReferenceCache(size int) *referenceCache {
+	return &referenceCache{cache: newLRUCache(size)}
+}
+
+// get returns the cached reference for the repository name, marking it as recently used
+func (c *referenceCache) get(repoName string) (reference.Named, bool) {
+	ref, ok := c.cache.get(repoName)
+	if !ok {
+		return nil, false
+	}
+	return ref.(reference.Named), true
+}
+
+// add caches the reference for the repository name, evicting the least recently used
+// reference if the cache is full
+func (c *referenceCache) add(repoName string, ref reference.Named) {
+	c.cache.add(repoName, ref)
+}
+
+// parseRepositoryName parses the reference of the repository's path. References are
+// memoized if ReferenceCacheSize is set.
+func (s *RegistryService) parseRepositoryName(repoName string) (reference.Named, error) {
+	if s.config.ReferenceCacheSize <= 0 {
+		return s.parseRepositoryPath(repoName)
+	}
+	s.referencesOnce.Do(func() {
+		s.references = newReferenceCache(s.config.ReferenceCacheSize)
+	})
+	if ref, ok := s.references.get(repoName); ok {
+		return ref, nil
+	}
+	ref, err := s.parseRepositoryPath(repoName)
+	if err != nil {
+		return nil, err
+	}
+	s.references.add(repoName, ref)
+	return ref, nil
+}
+
+// parseRepositoryPath parses the reference of the repository's path, or resolves it
+// with the Normalizer if there is one
+func (s *RegistryService) parseRepositoryPath(repoName string) (reference.Named, error) {
+	if s.config.Normalizer != nil {
+		return s.config.Normalizer(repoName)
+	}
+	fullRepoName, err := s.repositoryPath(repoName)
+	if err != nil {
+		return nil, err
+	}
+	return reference.ParseNamed(fullRepoName)
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferenceCache(t *testing.T) {
+	cache := newReferenceCache(2)
+	for _, name := range []string{"vili", "vili-api", "vili-ui"} {
+		ref, err := reference.ParseNamed(name)
+		assert.NoError(t, err)
+		cache.add(name, ref)
+		if name == "vili-api" {
+			// mark vili as recently used, so vili-api is evicted instead
+			_, ok := cache.get("vili")
+			assert.True(t, ok)
+		}
+	}
+
+	_, ok := cache.get("vili-api")
+	assert.False(t, ok)
+	for _, name := range []string{"vili", "vili-ui"} {
+		ref, ok := cache.get(name)
+		assert.True(t, ok)
+		assert.Equal(t, name, ref.Name())
+	}
+}
+
+func TestRegistryParseRepositoryName(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{Namespace: "airware", ReferenceCacheSize: 1}}
+	ref, err := testService.parseRepositoryName("vili")
+	assert.NoError(t, err)
+	assert.Equal(t, "airware/vili", ref.Name())
+
+	cached, err := testService.parseRepositoryName("vili")
+	assert.NoError(t, err)
+	assert.True(t, ref == cached)
+
+	_, err = testService.parseRepositoryName("Vili")
+	assert.Error(t, err)
+}
+
+func TestRegistryNormalizer(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"mirror/vili": {
+			"1500000000-abcdef": testDigest("a"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:   server.URL,
+		Namespace: "airware",
+		Normalizer: func(repo string) (reference.Named, error) {
+			if repo != "vili" {
+				return nil, fmt.Errorf("unknown repository %s", repo)
+			}
+			return reference.ParseNamed("mirror/" + repo)
+		},
+	}}
+	images, err := testService.GetRepository("vili", nil)
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+
+	fullName, err := testService.FullName("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, testService.pullDomain()+"/mirror/vili:1500000000-abcdef", fullName)
+	fullName, err = testService.FullNameByDigest("vili", testDigest("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, testService.pullDomain()+"/mirror/vili@"+testDigest("a"), fullName)
+
+	_, err = testService.GetRepository("redis", nil)
+	assert.EqualError(t, err, "unknown repository redis")
+	_, err = testService.FullName("redis", "1500000000-abcdef")
+	assert.EqualError(t, err, "unknown repository redis")
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// registryDefinition is a registry defined in a registries file
+type registryDefinition struct {
+	Name             string `json:"name"`
+	URL              string `json:"url"`
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	Namespace        string `json:"namespace"`
+	PullDomain       string `json:"pullDomain"`
+	TokenFile        string `json:"tokenFile"`
+	ClientCert       string `json:"clientCert"`
+	ClientKey        string `json:"clientKey"`
+	BranchPrefixTags bool   `json:"branchPrefixTags"`
+	TimestampUnit    string `json:"timestampUnit"`
+	Flavor           string `json:"flavor"`
+	UsePushTime      bool   `json:"usePushTime"`
+	MaxConcurrency   int    `json:"maxConcurrency"`
+}
+
+// LoadRegistriesFromFile reads the registry configurations defined in a YAML or JSON
+// file, as a list of registries under the registries key, each with a url and
+// optionally a username, password, namespace and the common options. References to
+// environment variables, such as ${REGISTRY_PASSWORD}, are expanded in the username,
+// password and token file, and must be set. Unknown fields are rejected.
+func LoadRegistriesFromFile(path string) ([]*RegistryConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Registries []registryDefinition `json:"registries"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := checkUnknownFields(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Registries) == 0 {
+		return nil, fmt.Errorf("%s: no registries defined", path)
+	}
+
+	configs := make([]*RegistryConfig, 0, len(file.Registries))
+	for i, definition := range file.Registries {
+		name := definition.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		config, err := definition.registryConfig()
+		if err != nil {
+			return nil, fmt.Errorf("%s: registry %s: %v", path, name, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// checkUnknownFields returns an error for the first field of a registries file that
+// is not a registry option, so that misspelled options are not silently ignored. The
+// vendored YAML package has no strict decoding, so the file is decoded strictly as JSON.
+func checkUnknownFields(data []byte) error {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Registries []map[string]json.RawMessage `json:"registries"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return err
+	}
+
+	fields := make(map[string]bool)
+	definitionType := reflect.TypeOf(registryDefinition{})
+	for i := 0; i < definitionType.NumField(); i++ {
+		fields[definitionType.Field(i).Tag.Get("json")] = true
+	}
+	for i, definition := range file.Registries {
+		var keys []string
+		for key := range definition {
+			if !fields[key] {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		name := fmt.Sprintf("#%d", i+1)
+		var definedName string
+		if json.Unmarshal(definition["name"], &definedName) == nil && definedName != "" {
+			name = definedName
+		}
+		return fmt.Errorf("registry %s: unknown field %q", name, keys[0])
+	}
+	return nil
+}
+
+// NewRegistriesFromFile returns a registry service for each of the registries defined
+// in a file read by LoadRegistriesFromFile
+func NewRegistriesFromFile(path string) ([]*RegistryService, error) {
+	configs, err := LoadRegistriesFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*RegistryService, len(configs))
+	for i, config := range configs {
+		services[i] = NewRegistry(config)
+	}
+	return services, nil
+}
+
+// registryConfig validates the definition and returns its registry configuration
+func (d *registryDefinition) registryConfig() (*RegistryConfig, error) {
+	if d.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	baseURL, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %v", d.URL, err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: must be an http or https URL", d.URL)
+	}
+
+	config := &RegistryConfig{
+		BaseURL:          strings.TrimSuffix(d.URL, "/"),
+		Namespace:        d.Namespace,
+		PullDomain:       d.PullDomain,
+		ClientCert:       d.ClientCert,
+		ClientKey:        d.ClientKey,
+		BranchPrefixTags: d.BranchPrefixTags,
+		UsePushTime:      d.UsePushTime,
+		MaxConcurrency:   d.MaxConcurrency,
+	}
+	if config.Username, err = expandEnv(d.Username); err != nil {
+		return nil, fmt.Errorf("username: %v", err)
+	}
+	if config.Password, err = expandEnv(d.Password); err != nil {
+		return nil, fmt.Errorf("password: %v", err)
+	}
+	if config.TokenFile, err = expandEnv(d.TokenFile); err != nil {
+		return nil, fmt.Errorf("tokenFile: %v", err)
+	}
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return nil, fmt.Errorf("clientCert and clientKey must be set together")
+	}
+
+	switch unit := TimestampUnit(d.TimestampUnit); unit {
+	case TimestampAuto, TimestampSeconds, TimestampMilliseconds, TimestampMicroseconds, TimestampNanoseconds:
+		config.TimestampUnit = unit
+	default:
+		return nil, fmt.Errorf("invalid timestampUnit %q", d.TimestampUnit)
+	}
+	switch flavor := RegistryFlavor(d.Flavor); flavor {
+	case FlavorDistribution, FlavorHarbor, FlavorACR:
+		config.Flavor = flavor
+	default:
+		return nil, fmt.Errorf("invalid flavor %q", d.Flavor)
+	}
+	if d.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("invalid maxConcurrency %d", d.MaxConcurrency)
+	}
+	return config, nil
+}
+
+// expandEnv expands the environment variable references in the value, failing if any
+// of them are not set
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := os.Expand(value, func(name string) string {
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRegistriesFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadRegistriesFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vili-registries")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("VILI_TEST_REGISTRY_PASSWORD", "secret")
+	defer os.Unsetenv("VILI_TEST_REGISTRY_PASSWORD")
+
+	path := writeRegistriesFile(t, dir, "registries.yaml", `
+registries:
+- name: quay
+  url: https://quay.io/
+  username: airware+vili
+  password: ${VILI_TEST_REGISTRY_PASSWORD}
+  namespace: airware
+  branchPrefixTags: true
+  flavor: harbor
+- url: https://registry.example.com
+  timestampUnit: ms
+`)
+	configs, err := LoadRegistriesFromFile(path)
+	if assert.NoError(t, err) && assert.Len(t, configs, 2) {
+		assert.Equal(t, &RegistryConfig{
+			BaseURL:          "https://quay.io",
+			Username:         "airware+vili",
+			Password:         "secret",
+			Namespace:        "airware",
+			BranchPrefixTags: true,
+			Flavor:           FlavorHarbor,
+		}, configs[0])
+		assert.Equal(t, TimestampMilliseconds, configs[1].TimestampUnit)
+	}
+
+	path = writeRegistriesFile(t, dir, "registries.json", `{"registries": [{"url": "https://quay.io", "namespace": "airware"}]}`)
+	services, err := NewRegistriesFromFile(path)
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "airware", services[0].config.Namespace)
+	}
+
+	for content, message := range map[string]string{
+		"registries: []":                                                      "no registries defined",
+		"registries:\n- username: vili":                                       "registry #1: url is required",
+		"registries:\n- name: quay\n  url: quay.io":                           "registry quay: invalid url",
+		"registries:\n- url: https://quay.io\n  flavor: gitlab":               "invalid flavor",
+		"registries:\n- url: https://quay.io\n  password: ${VILI_TEST_UNSET}": "environment variable VILI_TEST_UNSET is not set",
+		"registries: {": "registries.yaml",
+		"registries:\n- name: quay\n  url: https://quay.io\n  usePushtime: true": `registry quay: unknown field "usePushtime"`,
+		"registries:\n- url: https://quay.io\nregistry: {}":                      `unknown field "registry"`,
+	} {
+		_, err := LoadRegistriesFromFile(writeRegistriesFile(t, dir, "registries.yaml", content))
+		if assert.Error(t, err, content) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package repository
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/airware/vili/log"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/reference"
@@ -22,146 +26,1051 @@ type RegistryConfig struct {
 	Username  string
 	Password  string
 	Namespace string
+	// RepoPathTemplate, if set, is a text/template rendering the repository path from
+	// the repository name, as .Repo, the Namespace, as .Namespace, and RepoPathParams,
+	// such as team/{{.team}}/service/{{.Repo}}. It replaces the Namespace prefix.
+	RepoPathTemplate string
+	RepoPathParams   map[string]string
+	// PrimaryURL, if set, is the URL of the primary registry that the BaseURL
+	// registry is a read replica of. Tags that GetTag and Exists don't find in the
+	// replica are looked up in the primary, in case they have not replicated yet.
+	PrimaryURL string
+	// HedgeDelay, if set along with PrimaryURL, hedges GetTag: if the BaseURL registry
+	// hasn't answered within HedgeDelay, the tag is also requested from the primary,
+	// and the first successful answer is returned while the other request is
+	// cancelled. Only tag lookups are hedged.
+	HedgeDelay time.Duration
+	// PullDomain is the registry domain used in image references returned by FullName,
+	// if it differs from the BaseURL host used for API calls
+	PullDomain string
+	// AllowedRegistries, if set, are the only registry hosts, with their ports if
+	// any, that FullName and FullNameByDigest return references to. References to
+	// other registries fail with an error wrapping ErrRegistryNotAllowed.
+	AllowedRegistries []string
+
+	// SortOrder is the order in which GetRepository returns images. By default
+	// the most recently modified images are returned first.
+	SortOrder SortOrder
+
+	// PerBranchLimit, if set, keeps only the most recently modified images of each
+	// branch, or the highest versions for SortSemver, up to this many per branch, so
+	// busy branches don't crowd out the others
+	PerBranchLimit int
+
+	// ErrorPolicy determines whether GetRepository fails when some branches could
+	// not be fetched. By default it only fails if no images were found.
+	ErrorPolicy ErrorPolicy
+
+	// RequireTag rejects calls without a tag instead of defaulting to latest
+	RequireTag bool
+
+	// MaxAge, if set, drops images last modified longer than MaxAge ago from
+	// listings. Images without a timestamp are kept unless ExcludeUntimestamped is set.
+	MaxAge time.Duration
+	// ExcludeUntimestamped drops images without a timestamp from listings
+	ExcludeUntimestamped bool
+	// OnlyParseable drops images whose tags don't parse into a timestamp and a
+	// revision from listings, such as aliases like latest or stable. Unlike
+	// ExcludeUntimestamped, images timestamped from their push time are dropped too.
+	OnlyParseable bool
+	// FutureSkewTolerance is how far in the future, according to the Clock, image
+	// timestamps may be before FuturePolicy applies, to tolerate build machines
+	// with slightly skewed clocks
+	FutureSkewTolerance time.Duration
+	// FuturePolicy determines how listings handle images timestamped further in the
+	// future than FutureSkewTolerance. By default they are kept as is.
+	FuturePolicy FuturePolicy
+
+	// MaxConcurrency is the maximum number of branches fetched concurrently,
+	// or unlimited if zero. It caps the branches fetched across all repositories by
+	// GetRepositories and GetRepositoryInNamespaces.
+	MaxConcurrency int
+	// RepoConcurrency is the maximum number of repositories fetched concurrently by
+	// GetRepositories and GetRepositoryInNamespaces, or unlimited if zero
+	RepoConcurrency int
+	// BranchConcurrency is the maximum number of branches of each repository fetched
+	// concurrently, or unlimited if zero. At most RepoConcurrency * BranchConcurrency
+	// branches are in flight, further capped by MaxConcurrency.
+	BranchConcurrency int
+	// MinBranchesSuccess makes GetRepository return as soon as this many branches
+	// have been fetched successfully, cancelling the fetches of the other branches,
+	// or wait for every branch if zero. GetRepositoryDetailed reports the cancelled
+	// branches as outstanding.
+	MinBranchesSuccess int
+	// Sequential makes GetRepository fetch the branches one at a time in the order
+	// they were given, rather than concurrently, for environments where concurrent
+	// connections cause problems or a deterministic request order is needed
+	Sequential bool
+
+	// UnparseableWarnThreshold is the fraction of a repository's tags not matching
+	// the tag format above which a warning is logged when fetching its images, as
+	// when the tagging scheme has changed, or never if zero
+	UnparseableWarnThreshold float64
+
+	// BranchPrefixTags indicates that tags are of the form <branch>-<unixsecs>-<sha>,
+	// in which case only tags prefixed with a branch's slug are returned for it
+	BranchPrefixTags bool
+
+	// TimestampUnit is the unit of the timestamp in tags. By default it is
+	// detected from the number of digits.
+	TimestampUnit TimestampUnit
+	// RequireGitRevision skips tags whose revision is not a plausible git sha of
+	// 7 to 40 hexadecimal characters
+	RequireGitRevision bool
+	// ShortRevisionLength, if set, populates the ShortRevision of images with their
+	// revision abbreviated to this many characters
+	ShortRevisionLength int
+	// ShortDigestLength, if set, populates the ShortDigest of images whose digest is
+	// resolved with their digest abbreviated by ShortDigest
+	ShortDigestLength int
+	// Clock, if set, returns the current time, used by NextTag, MaxAge and
+	// snapshots instead of the system clock. It only tells the time, so the polls
+	// of WaitForTag are still scheduled by system timers.
+	Clock func() time.Time
+
+	// ProxyCache indicates that the registry is a pull-through cache, whose tag
+	// listings only include the tags cached locally rather than every upstream tag
+	ProxyCache bool
+
+	// Flavor is the registry implementation, used to access vendor-specific APIs
+	Flavor RegistryFlavor
+	// UsePushTime populates image timestamps from the registry-reported push time
+	// when the registry flavor supports it, instead of from the tag
+	UsePushTime bool
+
+	// FetchTagMetadata populates the last pull time and immutability of images from
+	// the registry's vendor API when the registry flavor supports it
+	FetchTagMetadata bool
+
+	// ArchSuffixes are the architecture suffixes stripped from the end of tags
+	// into the image's Arch. If nil, common architectures are recognized.
+	ArchSuffixes []string
+
+	// FetchManifestInfo populates the manifest media type and schema version of
+	// listed images, at the cost of a manifest request per tag
+	FetchManifestInfo bool
+	// ResolveDigests populates the manifest digest of listed images, at the cost
+	// of a manifest request per tag
+	ResolveDigests bool
+	// PlatformDigests, with ResolveDigests, populates the digest of listed images
+	// that are manifest lists with the digest of their DefaultPlatform image, so
+	// that it can be pulled directly, keeping the list digest in IndexDigest. Images
+	// whose list has no image for the platform are dropped. It costs a further
+	// manifest request per manifest list.
+	PlatformDigests bool
+	// PlatformTagDigests resolves the digest returned by GetTag for manifest lists to
+	// that of their DefaultPlatform image, or of their first image if there is none,
+	// instead of the list digest. It costs a manifest request per call.
+	PlatformTagDigests bool
+	// Dedupe collapses images with identical digests across branches into a single
+	// image listing all of its branches. It implies ResolveDigests.
+	Dedupe bool
+	// AllowSchema1 accepts deprecated schema1 manifests when inspecting manifests
+	AllowSchema1 bool
+	// LabelSelector, if set, only lists images whose config labels match the
+	// selector, a comma-separated list of key=value and key requirements. It
+	// costs a manifest and config request per tag.
+	LabelSelector string
+	// BranchLabel, if set and tags are not branch-prefixed, is the config label, such
+	// as git.branch, that images are attributed to branches by. Images whose label
+	// doesn't match the requested branch are dropped. It costs a manifest and config
+	// request per tag, limited to ManifestConcurrency at a time.
+	BranchLabel string
+	// DefaultPlatform is the os/arch platform, such as linux/arm64, whose image is
+	// inspected when inspecting a manifest list. Defaults to linux/amd64.
+	DefaultPlatform string
+	// MaxManifestSize is the maximum size of a fetched manifest, in bytes. Larger
+	// manifests are rejected with a ManifestTooLargeError. Defaults to 4MiB.
+	MaxManifestSize int64
+	// ManifestConcurrency is the maximum number of concurrent manifest requests
+	// per branch. Defaults to 5.
+	ManifestConcurrency int
+	// MaxBytesPerOp, if set, caps the total bytes downloaded by a single storage
+	// report, shared blob scan or blob download, which is aborted with a
+	// TransferLimitError once the limit is exceeded
+	MaxBytesPerOp int64
+	// VerifyBlobs verifies the content of blobs streamed by GetBlob against their digest
+	VerifyBlobs bool
+	// ConditionalTagLists sends the ETag of the last tag list response in an
+	// If-None-Match header, reusing the cached response if the registry answers
+	// 304 Not Modified, so unchanged repositories are cheap to poll
+	ConditionalTagLists bool
+	// TagListCacheSize is the maximum number of tag list responses cached for
+	// ConditionalTagLists, evicting the least recently used. Defaults to 1000.
+	TagListCacheSize int
+
+	// ReferenceCacheSize, if set, memoizes the parsed references of up to this
+	// many repository names, evicting the least recently used
+	ReferenceCacheSize int
+	// Normalizer, if set, resolves repository names to the references fetched from
+	// the registry and used in image names, in place of the namespace and
+	// RepoPathTemplate, for registries with naming rules of their own
+	Normalizer func(repo string) (reference.Named, error)
+
+	// TokenFile, if set, is the path of a file holding a bearer token used to
+	// authorize registry requests instead of the username and password. The file
+	// is re-read whenever it changes, so the token can be rotated.
+	TokenFile string
+	// ClientCert and ClientKey, if set, are the paths of a PEM encoded client
+	// certificate and key presented on every registry connection, for registries
+	// that require mutual TLS
+	ClientCert string
+	ClientKey  string
+
+	// AuthCache, if set, shares auth challenges and tokens with the other services
+	// configured with the same cache and the same registry URL and credentials. Token
+	// requests are made with the transport of the service that first needed the token.
+	AuthCache *AuthCache
+
+	// RequestInterceptor, if set, is invoked on every outbound request,
+	// including the /v2/ probe and token requests
+	RequestInterceptor RequestInterceptor
+	// RequestIDHeader, if set, is the header carrying a request ID on every outbound
+	// request. The ID is taken from the context of requests made with a context
+	// from WithRequestID, and generated for each request otherwise.
+	RequestIDHeader string
+	// DialContext, if set, is used to dial all registry connections instead of
+	// the default dialer
+	DialContext DialContextFunc
+	// IdleConnTimeout, if set, closes keep-alive connections that have been idle for
+	// longer, instead of after the default 90 seconds. Set it below the idle timeout
+	// of any load balancer in front of the registry, so that the balancer doesn't
+	// reset connections while they are pooled.
+	IdleConnTimeout time.Duration
 }
 
 // RegistryService is an implementation of the docker Service interface
 // It fetches docker images
 type RegistryService struct {
 	config *RegistryConfig
+
+	mutex            sync.Mutex
+	challengeManager auth.ChallengeManager
+	transports       map[string]http.RoundTripper
+	tokenFile        *tokenFile
+
+	unsupportedMediaTypes map[string]bool
+
+	httpTransportOnce sync.Once
+	httpTransport     http.RoundTripper
+	canonicalURL      atomic.Value
+
+	referencesOnce sync.Once
+	references     *referenceCache
+
+	repoPathOnce sync.Once
+	repoPath     *template.Template
+	repoPathErr  error
+
+	tagListsOnce sync.Once
+	tagLists     *lruCache
+
+	knownRepositoriesOnce sync.Once
+	knownRepositories     *lruCache
+
+	primaryOnce    sync.Once
+	primaryService *RegistryService
+
+	// after, if set, replaces the timers between the polls of WaitForTag
+	after func(time.Duration) <-chan time.Time
 }
 
 // InitRegistry initializes the docker registry service
 func InitRegistry(c *RegistryConfig) error {
-	dockerService = &RegistryService{
+	setDockerService(NewRegistry(c))
+	return nil
+}
+
+// NewRegistry returns a registry service with the given configuration, for callers
+// that use several registries instead of the docker registry service
+func NewRegistry(c *RegistryConfig) *RegistryService {
+	return &RegistryService{
 		config: c,
 	}
-	return nil
 }
 
-// GetRepository implements the Service interface
+// GetRepository implements the Service interface. If no branches are given, all of
+// the images in the repository are returned: for branch-prefixed tags, those of every
+// discovered branch, and otherwise every image, with an empty Branch. Failed branches
+// are handled according to the ErrorPolicy.
 func (s *RegistryService) GetRepository(repo string, branches []string) ([]*Image, error) {
+	return s.getImagesForBranches(repo, branches, newLimiter(s.config.MaxConcurrency))
+}
+
+// GetRepositoryDetailed fetches the images for the given branches like GetRepository,
+// along with the fetch stats of each branch. The result is returned even if the
+// fetch fails, with the error of each failed branch recorded in its stats.
+func (s *RegistryService) GetRepositoryDetailed(repo string, branches []string) (*RepositoryResult, error) {
+	return s.getRepositoryResult(repo, branches, newLimiter(s.config.MaxConcurrency), nil)
+}
+
+// GetRepositoryByRevision fetches the images for the given branches like GetRepository,
+// grouped by their revision. Images without a revision are omitted. The images for
+// each revision are sorted with the most recently modified first.
+func (s *RegistryService) GetRepositoryByRevision(repo string, branches []string) (map[string][]*Image, error) {
+	images, err := s.GetRepository(repo, branches)
+	if err != nil && images == nil {
+		return nil, err
+	}
+	revisions := make(map[string][]*Image)
+	for _, image := range images {
+		if image.Revision == "" {
+			continue
+		}
+		revisions[image.Revision] = append(revisions[image.Revision], image)
+	}
+	for _, revisionImages := range revisions {
+		sortByLastModified(revisionImages)
+	}
+	return revisions, err
+}
+
+// DistinctRevisions returns the sorted, distinct revisions parsed from the repository's
+// tags for the given branches, or for all branches if none are given. Unlike
+// GetRepositoryByRevision, it only lists the tags once and fetches no image metadata.
+func (s *RegistryService) DistinctRevisions(repo string, branches []string) ([]string, error) {
+	repository, err := s.getRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var revisions []string
+	for _, tag := range tags {
+		var revision string
+		if len(branches) == 0 {
+			if parsed, ok := s.splitTag(tag); ok {
+				revision = parsed.revision
+			}
+		}
+		for _, branch := range branches {
+			if image, ok := s.parseTag(tag, branch); ok {
+				revision = image.Revision
+				break
+			}
+		}
+		if revision == "" || seen[revision] {
+			continue
+		}
+		seen[revision] = true
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	return revisions, nil
+}
+
+// GetRepositorySinceTag fetches the images for the given branches like GetRepository,
+// returning only those modified after the image with the given tag. The tag's
+// timestamp is taken from the fetched images, or parsed from the tag if it is not
+// among them. Images whose tags have no timestamp are excluded.
+func (s *RegistryService) GetRepositorySinceTag(repo string, branches []string, sinceTag string) ([]*Image, error) {
+	images, err := s.GetRepository(repo, branches)
+	if err != nil && images == nil {
+		return nil, err
+	}
+
+	var since time.Time
+	for _, image := range images {
+		if image.Tag == sinceTag {
+			since = image.LastModified
+			break
+		}
+	}
+	if since.IsZero() {
+		parsed, ok := s.splitTag(sinceTag)
+		if !ok || parsed.lastModified.IsZero() {
+			return nil, fmt.Errorf("tag %s has no timestamp", sinceTag)
+		}
+		since = parsed.lastModified
+	}
+
+	var newer []*Image
+	for _, image := range images {
+		if image.LastModified.After(since) {
+			newer = append(newer, image)
+		}
+	}
+	return newer, err
+}
+
+// GetRepositories fetches the images for multiple repositories concurrently, with the
+// given branches for each. MaxConcurrency bounds the branch fetches across all of the
+// repositories combined. If any repository fails, the returned error is a
+// RepositoriesError holding the error for each failed repository.
+func (s *RegistryService) GetRepositories(repos map[string][]string) (map[string][]*Image, error) {
+	lim := newLimiter(s.config.MaxConcurrency)
+	repoLim := newLimiter(s.config.RepoConcurrency)
+
 	var waitGroup sync.WaitGroup
-	imagesChan := make(chan getImagesResult, len(branches))
+	var mutex sync.Mutex
+	repoImages := make(map[string][]*Image, len(repos))
+	repoErrors := make(RepositoriesError)
 
-	for _, branch := range branches {
+	for repo, branches := range repos {
 		waitGroup.Add(1)
-		go func(branch string) {
+		go func(repo string, branches []string) {
 			defer waitGroup.Done()
-			images, err := s.getImagesForBranch(repo, branch)
-			imagesChan <- getImagesResult{images: images, err: err}
-		}(branch)
+			repoLim.acquire()
+			defer repoLim.release()
+			images, err := s.getImagesForBranches(repo, branches, lim)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				repoErrors[repo] = err
+			}
+			if images != nil {
+				repoImages[repo] = images
+			}
+		}(repo, branches)
 	}
 
 	waitGroup.Wait()
-	close(imagesChan)
+	if len(repoErrors) > 0 {
+		return repoImages, repoErrors
+	}
+	return repoImages, nil
+}
+
+// GetRepositoryInNamespaces fetches the images for the given branches of the repository
+// in each of the given namespaces concurrently, in place of the configured namespace,
+// sharing the MaxConcurrency limit. Each image's Namespace is set to the namespace it
+// was found in. With SortNone, images are grouped by namespace in the order the
+// namespaces were given. If some namespaces could not be fetched, the images of the others are
+// returned with a RepositoriesError keyed by the failed repository paths.
+func (s *RegistryService) GetRepositoryInNamespaces(namespaces []string, repo string, branches []string) ([]*Image, error) {
+	lim := newLimiter(s.config.MaxConcurrency)
+	repoLim := newLimiter(s.config.RepoConcurrency)
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	namespaceImages := make([][]*Image, len(namespaces))
+	repoErrors := make(RepositoriesError)
 
+	for i, namespace := range namespaces {
+		waitGroup.Add(1)
+		go func(i int, namespace string) {
+			defer waitGroup.Done()
+			repoLim.acquire()
+			defer repoLim.release()
+			repoPath := "/" + strings.Trim(namespace, "/") + "/" + repo
+			images, err := s.getImagesForBranches(repoPath, branches, lim)
+			for _, image := range images {
+				image.Namespace = namespace
+			}
+			namespaceImages[i] = images
+			if err != nil {
+				mutex.Lock()
+				repoErrors[strings.TrimPrefix(repoPath, "/")] = err
+				mutex.Unlock()
+			}
+		}(i, namespace)
+	}
+
+	waitGroup.Wait()
 	var images []*Image
+	for _, namespaceImages := range namespaceImages {
+		images = append(images, namespaceImages...)
+	}
+	s.sortImages(images)
+	if len(repoErrors) > 0 {
+		return images, repoErrors
+	}
+	return images, nil
+}
+
+func (s *RegistryService) getImagesForBranches(repo string, branches []string, lim limiter) ([]*Image, error) {
+	result, err := s.getRepositoryResult(repo, branches, lim, nil)
+	if err != nil && s.config.ErrorPolicy != ErrorPolicyCollect {
+		return nil, err
+	}
+	return result.Images, err
+}
+
+// getRepositoryResult fetches the images for the branches, each with a slice of the
+// deadlines if there are any
+func (s *RegistryService) getRepositoryResult(repo string, branches []string, lim limiter, deadlines *branchDeadlines) (*RepositoryResult, error) {
+	result := &RepositoryResult{
+		Branches: make(map[string]*BranchStats, len(branches)),
+	}
+	if len(branches) == 0 {
+		if !s.config.BranchPrefixTags {
+			branches = []string{""}
+		} else {
+			discovered, err := s.DiscoverBranches(repo)
+			if err != nil || len(discovered) == 0 {
+				return result, err
+			}
+			branches = discovered
+		}
+	}
+	quorum := newBranchQuorum(s.config.MinBranchesSuccess, len(branches))
+	defer quorum.release()
+	deadlines = quorum.attach(deadlines)
+	if deadlines != nil {
+		deadlines.divide(len(branches))
+	}
+	results := make([]getImagesResult, len(branches))
+
+	fetchBranch := func(i int, branch string) {
+		lim.acquire()
+		defer lim.release()
+		if quorum.reached() {
+			results[i] = getImagesResult{stats: &BranchStats{Outstanding: true}}
+			return
+		}
+		wrapTransport, done := deadlines.begin()
+		defer done()
+		stats := &BranchStats{}
+		start := time.Now()
+		images, err := s.getImagesForBranch(repo, branch, stats, wrapTransport)
+		stats.Duration = time.Since(start)
+		if err == nil {
+			quorum.succeeded()
+		} else if quorum.outstanding(err) {
+			stats.Outstanding = true
+			images, err = nil, nil
+		}
+		stats.Err = err
+		results[i] = getImagesResult{images: images, stats: stats, err: err}
+	}
+
+	if s.config.Sequential {
+		for i, branch := range branches {
+			fetchBranch(i, branch)
+		}
+	} else {
+		var waitGroup sync.WaitGroup
+		branchLim := newLimiter(s.config.BranchConcurrency)
+		for i, branch := range branches {
+			waitGroup.Add(1)
+			go func(i int, branch string) {
+				defer waitGroup.Done()
+				// the repository's limit is acquired first, so that branches waiting
+				// on it don't hold up the other repositories' branches
+				branchLim.acquire()
+				defer branchLim.release()
+				fetchBranch(i, branch)
+			}(i, branch)
+		}
+		waitGroup.Wait()
+	}
+
 	var err error
-	for result := range imagesChan {
-		if result.err != nil {
-			err = result.err
+	branchErrors := make(BranchesError)
+	for i, branchResult := range results {
+		if branchResult.err != nil {
+			err = branchResult.err
+			branchErrors[branches[i]] = branchResult.err
 		}
-		images = append(images, result.images...)
+		if branchResult.stats.Outstanding {
+			result.Outstanding = append(result.Outstanding, branches[i])
+		}
+		result.Images = append(result.Images, s.limitBranchImages(branchResult.images)...)
+		result.Branches[branches[i]] = branchResult.stats
+	}
+	sort.Strings(result.Outstanding)
+	s.warnUnparseable(repo, result.Branches)
+	// a failure of every branch is reported in full, so that it can't be
+	// mistaken for a repository without images
+	if len(branchErrors) == len(branches) && len(branches) > 1 {
+		err = branchErrors
 	}
 
-	if len(images) == 0 && err != nil {
-		return nil, err
+	switch s.config.ErrorPolicy {
+	case FailOnAny:
+		if len(branchErrors) > 0 {
+			return result, branchErrors
+		}
+	case FailOnAll:
+		if len(branchErrors) == len(branches) {
+			return result, branchErrors
+		}
+	case ErrorPolicyCollect:
+	default:
+		if len(result.Images) == 0 && err != nil {
+			return result, err
+		}
 	}
 
-	sortByLastModified(images)
-	return images, nil
+	s.sortImages(result.Images)
+	if s.config.Dedupe {
+		result.Images = dedupeImages(result.Images)
+	}
+	if s.config.ErrorPolicy == ErrorPolicyCollect && len(branchErrors) > 0 {
+		return result, branchErrors
+	}
+	return result, nil
 }
 
-// GetTag implements the Service interface
+// GetTag implements the Service interface. If no tag is given, latest is used
+// unless RequireTag is set. If the repository or tag is not known to the registry,
+// or to the PrimaryURL registry if there is one, an error wrapping
+// ErrRepositoryUnknown or ErrTagUnknown is returned. With PlatformTagDigests, the
+// digest of a manifest list is resolved to that of its DefaultPlatform image.
 func (s *RegistryService) GetTag(repo, tag string) (string, error) {
-	repository, err := s.getRepository(repo)
+	tag, err := s.resolveTag(tag)
 	if err != nil {
 		return "", err
 	}
+	if s.config.PrimaryURL != "" && s.config.HedgeDelay > 0 {
+		return s.hedgedGetTag(repo, tag)
+	}
+	dgst, err := s.getTag(context.Background(), repo, tag, nil)
+	if s.config.PrimaryURL != "" && isNotFound(err) {
+		return s.primary().GetTag(repo, tag)
+	}
+	return dgst, err
+}
 
-	desc, err := repository.Tags(context.Background()).Get(context.Background(), tag)
+// getTag returns the digest of the tag in the registry, cancelling its requests when
+// the context is done, and recording the response headers with the recorder if given
+func (s *RegistryService) getTag(ctx context.Context, repo, tag string, recorder *headerRecorder) (string, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return "", err
+	}
+	transport = &contextTransport{base: recorder.wrap(transport), ctx: ctx}
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), transport)
 	if err != nil {
 		return "", err
 	}
 
-	return desc.Digest.String(), nil
+	desc, err := repository.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		return "", s.manifestUnknownError(repo, tag, err)
+	}
+
+	dgst, err := parseDigest(desc.Digest.String())
+	if err != nil {
+		return "", err
+	}
+	if !s.config.PlatformTagDigests {
+		return dgst.String(), nil
+	}
+	m, err := s.getManifest(&http.Client{Transport: transport}, repoNameRef, dgst.String())
+	if err != nil || !m.isIndex() {
+		return dgst.String(), err
+	}
+	child, err := s.platformManifest(m, repoNameRef.Name(), tag)
+	if err != nil {
+		return "", err
+	}
+	return child.Digest, nil
 }
 
-// FullName implements the Service interface
+// FullName implements the Service interface. If no tag is given, latest is used
+// unless RequireTag is set. The returned name is validated as an image reference.
 func (s *RegistryService) FullName(repo, tag string) (string, error) {
-	if s.config.Namespace != "" {
-		repo = s.config.Namespace + "/" + repo
+	tag, err := s.resolveTag(tag)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.repositoryPath(repo); err != nil {
+		return "", err
+	}
+	if err := s.checkRegistryAllowed(); err != nil {
+		return "", err
+	}
+	fullName := s.FullNameUnchecked(repo, tag)
+	if _, err := reference.Parse(fullName); err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %w", fullName, err)
+	}
+	return fullName, nil
+}
+
+// FullNameUnchecked returns the complete docker image name like FullName, but without
+// defaulting the tag or validating the reference. It is intended for hot paths whose
+// repository names and tags are already known to be valid; use FullName otherwise.
+func (s *RegistryService) FullNameUnchecked(repo, tag string) string {
+	return s.pullDomain() + "/" + s.fullRepositoryName(repo) + ":" + tag
+}
+
+// resolveTag returns the tag to use for the given tag, defaulting to latest
+func (s *RegistryService) resolveTag(tag string) (string, error) {
+	if tag != "" {
+		return tag, nil
+	}
+	if s.config.RequireTag {
+		return "", ErrMissingTag
+	}
+	return defaultTag, nil
+}
+
+// FullNameByDigest returns the complete docker image name pinned to the given digest
+func (s *RegistryService) FullNameByDigest(repo, imageDigest string) (string, error) {
+	dgst, err := parseDigest(imageDigest)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkRegistryAllowed(); err != nil {
+		return "", err
+	}
+	return s.pullDomain() + "/" + s.fullRepositoryName(repo) + "@" + dgst.String(), nil
+}
+
+// checkRegistryAllowed returns an error wrapping ErrRegistryNotAllowed if image
+// references point at a registry that is not in AllowedRegistries
+func (s *RegistryService) checkRegistryAllowed() error {
+	if len(s.config.AllowedRegistries) == 0 {
+		return nil
+	}
+	domain := s.pullDomain()
+	for _, allowed := range s.config.AllowedRegistries {
+		if strings.EqualFold(domain, allowed) {
+			return nil
+		}
 	}
-	return s.config.BaseURL + "/" + repo + ":" + tag, nil
+	return fmt.Errorf("%s: %w", domain, ErrRegistryNotAllowed)
 }
 
-func (s *RegistryService) getImagesForBranch(repoName, branchName string) ([]*Image, error) {
-	repo, err := s.getRepository(repoName)
+// pullDomain returns the domain used in image references handed to clients
+func (s *RegistryService) pullDomain() string {
+	if s.config.PullDomain != "" {
+		return s.config.PullDomain
+	}
+	domain := strings.TrimPrefix(s.config.BaseURL, "https://")
+	domain = strings.TrimPrefix(domain, "http://")
+	return strings.TrimSuffix(domain, "/")
+}
+
+// getImagesForBranch fetches the images for the branch, recording the number of tags
+// seen and skipped in stats. The repository transport is wrapped with wrapTransport.
+func (s *RegistryService) getImagesForBranch(repoName, branchName string, stats *BranchStats, wrapTransport func(http.RoundTripper) http.RoundTripper) ([]*Image, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repoName)
+	if err != nil {
+		return nil, err
+	}
+	transport = wrapTransport(transport)
+	repo, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
 	if err != nil {
 		return nil, err
 	}
 
-	tags, err := repo.Tags(context.Background()).All(context.Background())
+	tags, err := listTags(repo)
 	if err != nil {
 		return nil, err
 	}
 
+	var metadata map[string]*tagMetadata
+	if s.config.UsePushTime || s.config.FetchTagMetadata {
+		metadata, err = s.getTagMetadata(repoName)
+		if err != nil {
+			log.WithError(err).Warnf("failed to get tag metadata for %s, falling back to tag timestamps", repoName)
+		}
+	}
+
+	stats.Tags = len(tags)
+	now := s.now()
 	var images []*Image
+	seen := make(map[string]bool, len(tags))
 	for _, tag := range tags {
-		image := &Image{
-			Tag:    tag,
-			Branch: branchName,
-		}
-		sepIndex := strings.LastIndex(tag, "-")
-		if sepIndex != -1 {
-			dateComponent, shaComponent := tag[:sepIndex], tag[sepIndex+1:]
-			unixSecs, err := strconv.ParseInt(dateComponent, 10, 0)
-			if err != nil {
-				continue
+		// the registry should never list a tag twice, but some do
+		if seen[tag] {
+			stats.Duplicates++
+			continue
+		}
+		seen[tag] = true
+		image, ok := s.parseTag(tag, branchName)
+		if !ok {
+			stats.Skipped++
+			if _, ok := s.splitTag(tag); !ok {
+				stats.Unparseable++
 			}
-			image.Revision = shaComponent
-			image.LastModified = time.Unix(unixSecs, 0)
+			continue
+		}
+		if tagMetadata, ok := metadata[tag]; ok {
+			s.setTagMetadata(image, tagMetadata)
+		}
+		if !s.admitImage(image, now) {
+			continue
 		}
 		images = append(images, image)
 	}
+	if stats.Duplicates > 0 {
+		log.WithField("repo", repoName).Debugf("registry listed %d duplicate tags of %s", stats.Duplicates, repoName)
+	}
+
+	if s.config.FetchManifestInfo || s.config.ResolveDigests || s.config.Dedupe {
+		if images, err = s.setManifestInfo(images, repoNameRef, transport); err != nil {
+			return nil, err
+		}
+	}
+	if s.config.LabelSelector != "" || s.branchFromLabel() {
+		return s.filterByLabels(images, repoNameRef, transport)
+	}
 	return images, nil
 }
 
+// warnUnparseable logs a warning if the fraction of the repository's tags that did
+// not match the tag format is above UnparseableWarnThreshold. Every branch lists
+// all of the repository's tags, so the counts of the largest listing are used
+// instead of summing them.
+func (s *RegistryService) warnUnparseable(repoName string, branches map[string]*BranchStats) {
+	if s.config.UnparseableWarnThreshold <= 0 {
+		return
+	}
+	stats := &BranchStats{}
+	for _, branchStats := range branches {
+		if branchStats.Tags > stats.Tags {
+			stats = branchStats
+		}
+	}
+	if stats.Tags == 0 {
+		return
+	}
+	if float64(stats.Unparseable)/float64(stats.Tags) > s.config.UnparseableWarnThreshold {
+		log.WithField("repo", repoName).Warnf("%d of %d tags of %s do not match the tag format",
+			stats.Unparseable, stats.Tags, repoName)
+	}
+}
+
+// sortImages sorts the images by the configured SortOrder
+func (s *RegistryService) sortImages(images []*Image) {
+	switch s.config.SortOrder {
+	case SortNone:
+	case SortSemver:
+		sortBySemver(images)
+	default:
+		sortByLastModified(images)
+	}
+}
+
+// limitBranchImages returns the first PerBranchLimit of a branch's images when sorted
+// by the configured SortOrder, most recently modified first for SortNone, or all of
+// them if there is no limit
+func (s *RegistryService) limitBranchImages(images []*Image) []*Image {
+	if s.config.PerBranchLimit <= 0 || len(images) <= s.config.PerBranchLimit {
+		return images
+	}
+	if s.config.SortOrder == SortSemver {
+		sortBySemver(images)
+	} else {
+		sortByLastModified(images)
+	}
+	return images[:s.config.PerBranchLimit]
+}
+
+// admitImage returns false if the image should be dropped from listings made at the
+// given time, because it is older than MaxAge, has no timestamp, or is timestamped
+// further in the future than FutureSkewTolerance under FutureSkip. Under FutureClamp,
+// the timestamps of such images are clamped to the given time.
+func (s *RegistryService) admitImage(image *Image, now time.Time) bool {
+	if image.LastModified.IsZero() {
+		return !s.config.ExcludeUntimestamped
+	}
+	if image.LastModified.After(now.Add(s.config.FutureSkewTolerance)) {
+		switch s.config.FuturePolicy {
+		case FutureSkip:
+			return false
+		case FutureClamp:
+			image.LastModified = now
+		}
+	}
+	return s.config.MaxAge <= 0 || !image.LastModified.Before(now.Add(-s.config.MaxAge))
+}
+
 func (s *RegistryService) getRepository(repoName string) (distribution.Repository, error) {
-	if s.config.Namespace != "" {
-		repoName = s.config.Namespace + "/" + repoName
+	repoNameRef, transport, err := s.getRepositoryTransport(repoName)
+	if err != nil {
+		return nil, err
 	}
-	repoNameRef, err := reference.ParseNamed(repoName)
+
+	repo, err := client.NewRepository(context.Background(), repoNameRef, s.registryURL(), transport)
 	if err != nil {
 		return nil, err
 	}
 
-	credentialStore := &basicCredentialStore{
-		Username: s.config.Username,
-		Password: s.config.Password,
+	return repo, nil
+}
+
+// getRepositoryTransport returns the full reference for the repository and a
+// transport authorized to pull from it. Transports are cached per repository, so that
+// tokens are reused across requests until they expire.
+func (s *RegistryService) getRepositoryTransport(repoName string) (reference.Named, http.RoundTripper, error) {
+	return s.getScopedTransport(repoName, "pull")
+}
+
+// getPushTransport returns the full reference for the repository and a transport
+// authorized to push to it
+func (s *RegistryService) getPushTransport(repoName string) (reference.Named, http.RoundTripper, error) {
+	return s.getScopedTransport(repoName, "pull", "push")
+}
+
+// getScopedTransport returns the full reference for the repository and a transport
+// authorized for the given actions on it, cached per repository and actions
+func (s *RegistryService) getScopedTransport(repoName string, actions ...string) (reference.Named, http.RoundTripper, error) {
+	repoNameRef, err := s.parseRepositoryName(repoName)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, err := s.getAuthorizedTransport(auth.RepositoryScope{
+		Repository: repoNameRef.Name(),
+		Actions:    actions,
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return repoNameRef, transport, nil
+}
+
+// getAuthorizedTransport returns a transport authorized for the token scope, cached
+// per scope
+func (s *RegistryService) getAuthorizedTransport(scope auth.Scope) (http.RoundTripper, error) {
+	transportKey := scope.String()
 
-	challengeManager := auth.NewSimpleChallengeManager()
-	resp, err := http.Get(s.config.BaseURL + "/v2/")
+	challengeManager, err := s.getChallengeManager(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	if err := challengeManager.AddResponse(resp); err != nil {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if transport, ok := s.transports[transportKey]; ok {
+		return transport, nil
+	}
+
+	baseURL, err := url.Parse(s.registryURL())
+	if err != nil {
 		return nil, err
 	}
+	baseTransport := s.baseTransport()
+	credentialStore := &basicCredentialStore{
+		Username: s.config.Username,
+		Password: s.config.Password,
+	}
 
-	transport := transport.NewTransport(http.DefaultTransport, auth.NewAuthorizer(
-		challengeManager,
-		auth.NewTokenHandler(http.DefaultTransport, credentialStore, repoName, "pull"),
-		auth.NewBasicHandler(credentialStore),
-	))
+	if s.config.TokenFile != "" && s.tokenFile == nil {
+		s.tokenFile = &tokenFile{path: s.config.TokenFile}
+	}
+	newModifier := func() transport.RequestModifier {
+		if s.config.TokenFile != "" {
+			return s.tokenFile
+		}
+		return auth.NewAuthorizer(
+			challengeManager,
+			auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+				Transport:   baseTransport,
+				Credentials: credentialStore,
+				Scopes:      []auth.Scope{scope},
+			}),
+			auth.NewBasicHandler(credentialStore),
+		)
+	}
+	var cacheEntry *authCacheEntry
+	if s.config.AuthCache != nil {
+		cacheEntry = s.config.AuthCache.entry(s.config)
+	}
+	var modifier transport.RequestModifier
+	authorize := func() http.RoundTripper {
+		if cacheEntry != nil {
+			modifier = cacheEntry.modifier(transportKey, modifier, newModifier)
+		} else {
+			modifier = newModifier()
+		}
+		return transport.NewTransport(baseTransport, &hostScopedModifier{
+			host:     baseURL.Host,
+			modifier: modifier,
+		})
+	}
+	transport := &reauthTransport{authorize: authorize, current: authorize()}
+
+	if s.transports == nil {
+		s.transports = make(map[string]http.RoundTripper)
+	}
+	s.transports[transportKey] = transport
+	return transport, nil
+}
+
+// isRegistryResponse returns true if the /v2/ probe response is from a v2 registry,
+// either by advertising the registry/2.0 API version or by issuing an auth challenge
+func isRegistryResponse(resp *http.Response) bool {
+	for _, version := range auth.APIVersions(resp, "Docker-Distribution-API-Version") {
+		if version.String() == "registry/2.0" {
+			return true
+		}
+	}
+	for _, challenge := range auth.ResponseChallenges(resp) {
+		switch strings.ToLower(challenge.Scheme) {
+		case "bearer", "basic":
+			return true
+		}
+	}
+	return false
+}
 
-	repo, err := client.NewRepository(context.Background(), repoNameRef, s.config.BaseURL, transport)
+// fullRepositoryName returns the repository path of the repository like repositoryPath,
+// logging a warning and returning "" if the RepoPathTemplate cannot be rendered
+func (s *RegistryService) fullRepositoryName(repoName string) string {
+	fullRepoName, err := s.repositoryPath(repoName)
 	if err != nil {
-		return nil, err
+		log.WithError(err).Warnf("failed to render repository path for %s", repoName)
 	}
+	return fullRepoName
+}
 
-	return repo, nil
+// repositoryPath returns the repository name rendered with the RepoPathTemplate, or
+// prefixed with the configured namespace if there is no template. Repository names
+// with a leading slash, such as /library/alpine, are root-scoped and are returned
+// without the slash, the template or the namespace. If there is a Normalizer, the
+// path is the name of the reference it resolves instead.
+func (s *RegistryService) repositoryPath(repoName string) (string, error) {
+	if s.config.Normalizer != nil {
+		ref, err := s.parseRepositoryName(repoName)
+		if err != nil {
+			return "", err
+		}
+		return ref.Name(), nil
+	}
+	if strings.HasPrefix(repoName, "/") {
+		return strings.TrimPrefix(repoName, "/"), nil
+	}
+	if s.config.RepoPathTemplate != "" {
+		s.repoPathOnce.Do(func() {
+			s.repoPath, s.repoPathErr = template.New("repo-path").Option("missingkey=error").Parse(s.config.RepoPathTemplate)
+		})
+		if s.repoPathErr != nil {
+			return "", fmt.Errorf("invalid repository path template: %w", s.repoPathErr)
+		}
+		data := map[string]string{"Namespace": s.config.Namespace}
+		for key, value := range s.config.RepoPathParams {
+			data[key] = value
+		}
+		data["Repo"] = repoName
+		var path strings.Builder
+		if err := s.repoPath.Execute(&path, data); err != nil {
+			return "", fmt.Errorf("failed to render repository path for %s: %w", repoName, err)
+		}
+		return path.String(), nil
+	}
+	if s.config.Namespace != "" {
+		return s.config.Namespace + "/" + repoName, nil
+	}
+	return repoName, nil
+}
+
+// baseTransport returns the transport used for all registry requests
+func (s *RegistryService) baseTransport() http.RoundTripper {
+	var base http.RoundTripper = &rateLimitTransport{base: &resetRetryTransport{base: s.getHTTPTransport()}}
+	if s.config.RequestInterceptor != nil {
+		base = &interceptorTransport{
+			base:        base,
+			interceptor: s.config.RequestInterceptor,
+		}
+	}
+	if s.config.RequestIDHeader != "" {
+		base = &requestIDTransport{
+			base:   base,
+			header: s.config.RequestIDHeader,
+		}
+	}
+	if s.config.ConditionalTagLists {
+		base = s.conditionalTagLists(base)
+	}
+	return base
 }
 
 // basicCredentialStore implements the distribution auth.CredentialStore interface
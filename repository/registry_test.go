@@ -1,10 +1,25 @@
 package repository
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/airware/vili/log"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -69,10 +84,932 @@ func TestRegistryFullName(t *testing.T) {
 			"abcdef",
 			"quay.io/airware/vili:testbranch-abcdef",
 		},
+		{
+			RegistryConfig{
+				BaseURL: "https://registry.internal.example.com/",
+			},
+			"vili",
+			"master",
+			"abcdef",
+			"registry.internal.example.com/vili:master-abcdef",
+		},
+		{
+			RegistryConfig{
+				BaseURL:    "https://registry.internal.example.com",
+				PullDomain: "registry.example.com",
+				Namespace:  "airware",
+			},
+			"vili",
+			"master",
+			"abcdef",
+			"registry.example.com/airware/vili:master-abcdef",
+		},
+		{
+			RegistryConfig{
+				BaseURL:   "quay.io",
+				Namespace: "airware",
+			},
+			"/library/redis",
+			"master",
+			"1.9.1",
+			"quay.io/library/redis:master-1.9.1",
+		},
 	} {
-		testService := &RegistryService{&testCase.RegistryConfig}
+		testService := &RegistryService{config: &testCase.RegistryConfig}
 		fullName, err := testService.FullName(testCase.repo, testCase.branch+"-"+testCase.tag)
 		assert.NoError(t, err)
 		assert.Equal(t, testCase.fullName, fullName)
+		assert.Equal(t, testCase.fullName, testService.FullNameUnchecked(testCase.repo, testCase.branch+"-"+testCase.tag))
+	}
+}
+
+func TestRegistryRootScopedRepository(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"base": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, Namespace: "airware"}}
+	digest, err := testService.GetTag("/base", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c", digest)
+
+	_, err = testService.GetTag("base", "master")
+	assert.Error(t, err)
+
+	_, err = testService.GetTag("/Base", "master")
+	assert.Error(t, err)
+}
+
+func TestRegistryRepoPathTemplate(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"team/platform/service/vili": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		Namespace:        "airware",
+		RepoPathTemplate: "team/{{.team}}/service/{{.Repo}}",
+		RepoPathParams:   map[string]string{"team": "platform"},
+	}}
+	digest, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c", digest)
+
+	fullName, err := testService.FullName("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://")+"/team/platform/service/vili:master", fullName)
+
+	missingParam := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		RepoPathTemplate: "team/{{.team}}/service/{{.Repo}}",
+	}}
+	_, err = missingParam.FullName("vili", "master")
+	assert.Error(t, err)
+	_, err = missingParam.GetTag("vili", "master")
+	assert.Error(t, err)
+}
+
+func TestRegistrySortNone(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"feature-1500000300-abcdef": "sha256:a",
+			"master-1500000100-bcdef0":  "sha256:b",
+			"master-1500000200-cdef01":  "sha256:c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		BranchPrefixTags: true,
+		SortOrder:        SortNone,
+	}}
+	images, err := testService.GetRepository("vili", []string{"master", "feature"})
+	assert.NoError(t, err)
+	var tags []string
+	for _, image := range images {
+		tags = append(tags, image.Tag)
+	}
+	assert.Equal(t, []string{"master-1500000100-bcdef0", "master-1500000200-cdef01", "feature-1500000300-abcdef"}, tags)
+
+	testService.config.SortOrder = SortLastModified
+	images, err = testService.GetRepository("vili", []string{"master", "feature"})
+	assert.NoError(t, err)
+	assert.Equal(t, "feature-1500000300-abcdef", images[0].Tag)
+}
+
+func TestRegistryPerBranchLimit(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"feature-1500000050-abcdef": "sha256:a",
+			"master-1500000100-bcdef0":  "sha256:b",
+			"master-1500000200-cdef01":  "sha256:c",
+			"master-1500000300-def012":  "sha256:d",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		BranchPrefixTags: true,
+		PerBranchLimit:   2,
+	}}
+	images, err := testService.GetRepository("vili", []string{"master", "feature"})
+	assert.NoError(t, err)
+	var tags []string
+	for _, image := range images {
+		tags = append(tags, image.Tag)
 	}
+	assert.Equal(t, []string{"master-1500000300-def012", "master-1500000200-cdef01", "feature-1500000050-abcdef"}, tags)
+}
+
+func TestRegistryGetRepositoryDetailed(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:a",
+			"1500000100-bcdef0": "sha256:b",
+			"notadate-cdef01":   "sha256:c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	result, err := testService.GetRepositoryDetailed("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, result.Images, 2)
+	stats := result.Branches["master"]
+	assert.Equal(t, 3, stats.Tags)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.NoError(t, stats.Err)
+
+	result, err = testService.GetRepositoryDetailed("missing", []string{"master"})
+	assert.Error(t, err)
+	assert.Error(t, result.Branches["master"].Err)
+}
+
+func TestRegistryGetRepositoryAllBranches(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"plain": {
+			"1500000000-abcdef": "sha256:a",
+			"1500000100-bcdef0": "sha256:b",
+		},
+		"vili": {
+			"master-1500000000-abcdef":  "sha256:a",
+			"develop-1500000100-bcdef0": "sha256:b",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	images, err := testService.GetRepository("plain", nil)
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "", images[0].Branch)
+
+	testService.config.BranchPrefixTags = true
+	images, err = testService.GetRepository("vili", []string{})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "develop", images[0].Branch)
+	assert.Equal(t, "master", images[1].Branch)
+
+	images, err = testService.GetRepositoryMatching("vili", "release-*")
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+}
+
+func TestRegistryErrorPolicy(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef":  "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"develop-1500000100-bcdef0": "invalid",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		BranchPrefixTags: true,
+		ResolveDigests:   true,
+	}}
+	for _, testCase := range []struct {
+		policy ErrorPolicy
+		images int
+		err    bool
+	}{
+		{FailOnEmpty, 1, false},
+		{FailOnAny, 0, true},
+		{FailOnAll, 1, false},
+		{ErrorPolicyCollect, 1, true},
+	} {
+		testService.config.ErrorPolicy = testCase.policy
+		images, err := testService.GetRepository("vili", []string{"master", "develop"})
+		assert.Len(t, images, testCase.images, string(testCase.policy))
+		if testCase.err {
+			assert.Contains(t, err.(BranchesError), "develop")
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	testService.config.ErrorPolicy = FailOnAll
+	_, err := testService.GetRepository("vili", []string{"develop"})
+	assert.Contains(t, err.(BranchesError), "develop")
+}
+
+func TestRegistryAllBranchesFailed(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"develop-1500000100-bcdef0": "invalid",
+			"release-1500000200-cdef01": "invalid",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:          server.URL,
+		BranchPrefixTags: true,
+		ResolveDigests:   true,
+	}}
+	images, err := testService.GetRepository("vili", []string{"develop", "release"})
+	assert.Empty(t, images)
+	if assert.IsType(t, BranchesError{}, err) {
+		assert.Len(t, err.(BranchesError), 2)
+	}
+
+	// an empty branch alongside a failed one still fails, with the branch's error
+	images, err = testService.GetRepository("vili", []string{"develop", "master"})
+	assert.Empty(t, images)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "Failed to fetch branches")
+
+	images, err = testService.GetRepository("vili", []string{"master", "feature"})
+	assert.Empty(t, images)
+	assert.NoError(t, err)
+
+	assert.True(t, isTransient(BranchesError{"develop": errors.New("invalid"), "release": &RateLimitedError{}}))
+}
+
+func TestRegistryMaxAge(t *testing.T) {
+	recent := strconv.FormatInt(time.Now().Add(-24*time.Hour).Unix(), 10) + "-aaaaaa"
+	old := strconv.FormatInt(time.Now().Add(-100*24*time.Hour).Unix(), 10) + "-bbbbbb"
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {recent: testDigest("a"), old: testDigest("b"), "latest": testDigest("a")},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, MaxAge: 90 * 24 * time.Hour}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	var tags []string
+	for _, image := range images {
+		tags = append(tags, image.Tag)
+	}
+	assert.Equal(t, []string{recent, "latest"}, tags)
+
+	testService.config.ExcludeUntimestamped = true
+	images, err = testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, recent, images[0].Tag)
+	}
+}
+
+func TestRegistryFuturePolicy(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1499999000-aaaaaa": testDigest("a"),
+			"1500000060-bbbbbb": testDigest("b"),
+			"1500003600-cccccc": testDigest("c"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:             server.URL,
+		Clock:               func() time.Time { return now },
+		FutureSkewTolerance: 5 * time.Minute,
+	}}
+	for _, testCase := range []struct {
+		policy FuturePolicy
+		tags   []string
+		newest int64
+	}{
+		{FutureKeep, []string{"1500003600-cccccc", "1500000060-bbbbbb", "1499999000-aaaaaa"}, 1500003600},
+		{FutureSkip, []string{"1500000060-bbbbbb", "1499999000-aaaaaa"}, 1500000060},
+		{FutureClamp, []string{"1500000060-bbbbbb", "1500003600-cccccc", "1499999000-aaaaaa"}, 1500000060},
+	} {
+		testService.config.FuturePolicy = testCase.policy
+		images, err := testService.GetRepository("vili", []string{"master"})
+		assert.NoError(t, err)
+		var tags []string
+		for _, image := range images {
+			tags = append(tags, image.Tag)
+		}
+		assert.Equal(t, testCase.tags, tags, string(testCase.policy))
+		assert.Equal(t, testCase.newest, images[0].LastModified.Unix(), string(testCase.policy))
+	}
+}
+
+func TestRegistryGetRepositoryByRevision(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:a",
+			"1500000200-abcdef": "sha256:a",
+			"1500000100-bcdef0": "sha256:b",
+			"latest":            "sha256:a",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, SortOrder: SortNone}}
+	revisions, err := testService.GetRepositoryByRevision("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, revisions, 2)
+	assert.Len(t, revisions["abcdef"], 2)
+	assert.Equal(t, "1500000200-abcdef", revisions["abcdef"][0].Tag)
+	assert.Equal(t, "1500000000-abcdef", revisions["abcdef"][1].Tag)
+	assert.Len(t, revisions["bcdef0"], 1)
+}
+
+func TestRegistryDistinctRevisions(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef":       testDigest("a"),
+			"master-1500000001-abcdef-arm64": testDigest("b"),
+			"develop-1500000002-bcdef0":      testDigest("c"),
+			"release-1500000003-cdef01":      testDigest("d"),
+			"latest":                         testDigest("a"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, BranchPrefixTags: true}}
+	revisions, err := testService.DistinctRevisions("vili", []string{"master", "develop"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abcdef", "bcdef0"}, revisions)
+
+	revisions, err = testService.DistinctRevisions("vili", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abcdef", "bcdef0", "cdef01"}, revisions)
+}
+
+func TestRegistryGetRepositorySinceTag(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:a",
+			"1500000100-bcdef0": "sha256:b",
+			"1500000200-cdef01": "sha256:c",
+			"latest":            "sha256:c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	images, err := testService.GetRepositorySinceTag("vili", []string{"master"}, "1500000100-bcdef0")
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "1500000200-cdef01", images[0].Tag)
+
+	images, err = testService.GetRepositorySinceTag("vili", []string{"master"}, "1400000000-012345")
+	assert.NoError(t, err)
+	assert.Len(t, images, 3)
+
+	_, err = testService.GetRepositorySinceTag("vili", []string{"master"}, "latest")
+	assert.Error(t, err)
+}
+
+func TestRegistryDefaultTag(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"latest": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	digest, err := testService.GetTag("vili", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c", digest)
+	fullName, err := testService.FullName("vili", "")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://")+"/vili:latest", fullName)
+
+	_, err = testService.FullName("vili", "bad tag")
+	assert.Error(t, err)
+	assert.Equal(t, strings.TrimPrefix(server.URL, "http://")+"/vili:bad tag", testService.FullNameUnchecked("vili", "bad tag"))
+
+	testService.config.RequireTag = true
+	_, err = testService.GetTag("vili", "")
+	assert.Equal(t, ErrMissingTag, err)
+	_, err = testService.FullName("vili", "")
+	assert.Equal(t, ErrMissingTag, err)
+}
+
+func TestRegistryFullNameByDigest(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:    "https://registry.internal.example.com",
+		PullDomain: "registry.example.com",
+	}}
+	imageDigest := digest.FromBytes([]byte("vili")).String()
+	fullName, err := testService.FullNameByDigest("vili", imageDigest)
+	assert.NoError(t, err)
+	assert.Equal(t, "registry.example.com/vili@"+imageDigest, fullName)
+}
+
+func TestRegistryAllowedRegistries(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:           "https://registry.internal.example.com",
+		PullDomain:        "Registry.Example.com",
+		AllowedRegistries: []string{"registry.example.com", "localhost:5000"},
+	}}
+	imageDigest := digest.FromBytes([]byte("vili")).String()
+	_, err := testService.FullName("vili", "latest")
+	assert.NoError(t, err)
+	_, err = testService.FullNameByDigest("vili", imageDigest)
+	assert.NoError(t, err)
+
+	testService.config.PullDomain = "registry.attacker.example.com"
+	_, err = testService.FullName("vili", "latest")
+	assert.True(t, errors.Is(err, ErrRegistryNotAllowed), "%v", err)
+	_, err = testService.FullNameByDigest("vili", imageDigest)
+	assert.True(t, errors.Is(err, ErrRegistryNotAllowed), "%v", err)
+
+	testService.config.AllowedRegistries = nil
+	_, err = testService.FullName("vili", "latest")
+	assert.NoError(t, err)
+}
+
+// testRegistry is a minimal in-memory v2 registry used by the tests
+type testRegistry struct {
+	// tags maps a repository name to its tags and their digests
+	tags map[string]map[string]string
+	// basicAuth, if set, is the Authorization header required on every request
+	basicAuth string
+	// manifests maps a tag or digest to its manifest body, served for GET requests
+	manifests map[string]string
+	// blobs is the set of blob digests in the registry
+	blobs map[string]bool
+	// upstreamTags maps a tag to its digest for tags served for manifest requests
+	// but not listed, as by a pull-through cache
+	upstreamTags map[string]string
+	// blobContents maps a blob digest to its content, served for GET requests
+	blobContents map[string]string
+	// blobURL, if set, is the host blob requests are redirected to
+	blobURL string
+
+	mutex    sync.Mutex
+	requests []*http.Request
+}
+
+// testDigest returns a valid sha256 digest derived from the given name
+func testDigest(name string) string {
+	return digest.FromBytes([]byte(name)).String()
+}
+
+func newTestRegistry(tags map[string]map[string]string) (*testRegistry, *httptest.Server) {
+	reg := &testRegistry{tags: tags}
+	return reg, httptest.NewServer(reg)
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mutex.Lock()
+	reg.requests = append(reg.requests, r)
+	reg.mutex.Unlock()
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if reg.basicAuth != "" && r.Header.Get("Authorization") != reg.basicAuth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case path == "_catalog":
+		var names []string
+		for name := range reg.tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil {
+			last := r.URL.Query().Get("last")
+			start := sort.SearchStrings(names, last)
+			if start < len(names) && names[start] == last {
+				start++
+			}
+			names = names[start:]
+			if len(names) > n {
+				names = names[:n]
+				w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?n=%d&last=%s>; rel="next"`, n, names[n-1]))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"repositories": names})
+	case strings.HasSuffix(path, "/tags/list"):
+		name := strings.TrimSuffix(path, "/tags/list")
+		repoTags, ok := reg.tags[name]
+		if !ok {
+			writeErrorCode(w, "NAME_UNKNOWN")
+			return
+		}
+		var tagList []string
+		for tag := range repoTags {
+			tagList = append(tagList, tag)
+		}
+		sort.Strings(tagList)
+		if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil {
+			last := r.URL.Query().Get("last")
+			start := sort.SearchStrings(tagList, last)
+			if start < len(tagList) && tagList[start] == last {
+				start++
+			}
+			tagList = tagList[start:]
+			if len(tagList) > n {
+				tagList = tagList[:n]
+				w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, name, n, tagList[n-1]))
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tagList})
+	case strings.Contains(path, "/blobs/") && reg.blobURL != "":
+		http.Redirect(w, r, reg.blobURL+r.URL.Path, http.StatusTemporaryRedirect)
+	case strings.Contains(path, "/blobs/"):
+		if body, ok := reg.blobContents[path[strings.LastIndex(path, "/")+1:]]; ok && r.Method == "GET" {
+			w.Write([]byte(body))
+			return
+		}
+		if !reg.blobs[path[strings.LastIndex(path, "/")+1:]] {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/manifests/"):
+		sepIndex := strings.LastIndex(path, "/manifests/")
+		name, ref := path[:sepIndex], path[sepIndex+len("/manifests/"):]
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			dgst := testDigest(string(body))
+			reg.mutex.Lock()
+			if reg.manifests == nil {
+				reg.manifests = make(map[string]string)
+			}
+			reg.manifests[ref] = string(body)
+			reg.tags[name][ref] = dgst
+			reg.mutex.Unlock()
+			w.Header().Set("Docker-Content-Digest", dgst)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if body, ok := reg.manifests[ref]; ok && r.Method == "GET" {
+			var m manifest
+			json.Unmarshal([]byte(body), &m)
+			w.Header().Set("Content-Type", m.MediaType)
+			w.Write([]byte(body))
+			return
+		}
+		digest, ok := reg.tags[name][ref]
+		if !ok {
+			digest, ok = reg.upstreamTags[ref]
+		}
+		if _, known := reg.tags[name]; !ok && !known {
+			writeErrorCode(w, "NAME_UNKNOWN")
+			return
+		}
+		if !ok {
+			writeErrorCode(w, "MANIFEST_UNKNOWN")
+			return
+		}
+		mediaType := MediaTypeSchema2
+		if body, ok := reg.manifests[digest]; ok {
+			var m manifest
+			json.Unmarshal([]byte(body), &m)
+			mediaType = m.MediaType
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeErrorCode writes a 404 Not Found registry error response with the error code
+func writeErrorCode(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":"not found"}]}`, code)
+}
+
+func TestRegistryRequestInterceptor(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL: server.URL,
+			RequestInterceptor: func(req *http.Request) error {
+				req.Header.Set("X-Signature", "signed:"+req.URL.Path)
+				return nil
+			},
+		},
+	}
+	digest, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c", digest)
+
+	assert.NotEmpty(t, reg.requests)
+	for _, req := range reg.requests {
+		assert.Equal(t, "signed:"+req.URL.Path, req.Header.Get("X-Signature"))
+	}
+}
+
+func TestRegistryCrossHostRedirect(t *testing.T) {
+	var blobAuth []string
+	blobServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blobAuth = append(blobAuth, r.Header.Get("Authorization"))
+		w.Write([]byte("blob"))
+	}))
+	defer blobServer.Close()
+
+	reg, server := newTestRegistry(map[string]map[string]string{"vili": {}})
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+	reg.blobURL = blobServer.URL
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:  server.URL,
+			Username: "user",
+			Password: "pass",
+		},
+	}
+	repo, err := testService.getRepository("vili")
+	assert.NoError(t, err)
+
+	blob, err := repo.Blobs(context.Background()).Get(context.Background(),
+		"sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c")
+	assert.NoError(t, err)
+	assert.Equal(t, "blob", string(blob))
+	assert.Equal(t, []string{""}, blobAuth)
+}
+
+func TestRegistryGetRepositories(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+			"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+		"redis": {
+			"1500000200-cdef01": "sha256:b2c3bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{
+		config: &RegistryConfig{
+			BaseURL:        server.URL,
+			MaxConcurrency: 1,
+		},
+	}
+	repoImages, err := testService.GetRepositories(map[string][]string{
+		"vili":    {"master"},
+		"redis":   {"master"},
+		"missing": {"master"},
+	})
+	assert.IsType(t, RepositoriesError{}, err)
+	assert.Contains(t, err.(RepositoriesError), "missing")
+	assert.Len(t, err.(RepositoriesError), 1)
+	assert.Len(t, repoImages["vili"], 2)
+	assert.Equal(t, "1500000100-bcdef0", repoImages["vili"][0].Tag)
+	assert.Len(t, repoImages["redis"], 1)
+}
+
+func TestRegistryRepoAndBranchConcurrency(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"a": {"master-1500000000-abcdef": testDigest("a")},
+		"b": {"master-1500000000-abcdef": testDigest("b")},
+		"c": {"master-1500000000-abcdef": testDigest("c")},
+	}}
+	var mutex sync.Mutex
+	inFlight := make(map[string]int)
+	var total, maxTotal, maxRepo, maxRepos int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/tags/list") {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+		mutex.Lock()
+		inFlight[repo]++
+		total++
+		if total > maxTotal {
+			maxTotal = total
+		}
+		if inFlight[repo] > maxRepo {
+			maxRepo = inFlight[repo]
+		}
+		repos := 0
+		for _, n := range inFlight {
+			if n > 0 {
+				repos++
+			}
+		}
+		if repos > maxRepos {
+			maxRepos = repos
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		reg.ServeHTTP(w, r)
+
+		mutex.Lock()
+		inFlight[repo]--
+		total--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:           server.URL,
+		BranchPrefixTags:  true,
+		MaxConcurrency:    3,
+		RepoConcurrency:   2,
+		BranchConcurrency: 2,
+	}}
+	branches := []string{"master", "develop", "feature"}
+	repoImages, err := testService.GetRepositories(map[string][]string{"a": branches, "b": branches, "c": branches})
+	assert.NoError(t, err)
+	assert.Len(t, repoImages, 3)
+	assert.True(t, maxTotal <= 3, "%d branches in flight", maxTotal)
+	assert.True(t, maxRepo <= 2, "%d branches of a repository in flight", maxRepo)
+	assert.True(t, maxRepos <= 2, "%d repositories in flight", maxRepos)
+	assert.True(t, maxTotal > 1)
+}
+
+func TestRegistrySequential(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {
+			"master-1500000100-bcdef0":  testDigest("a"),
+			"develop-1500000200-cdef01": testDigest("b"),
+			"feature-1500000300-def012": testDigest("c"),
+		},
+	}}
+	var mutex sync.Mutex
+	var inFlight, maxInFlight int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		reg.ServeHTTP(w, r)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:           server.URL,
+		BranchPrefixTags:  true,
+		FetchManifestInfo: true,
+		Sequential:        true,
+	}}
+	images, err := testService.GetRepository("vili", []string{"feature", "master", "develop"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 3)
+	assert.Equal(t, 1, maxInFlight)
+
+	var order []string
+	for _, r := range reg.requests {
+		if sepIndex := strings.Index(r.URL.Path, "/manifests/"); sepIndex != -1 {
+			order = append(order, strings.SplitN(r.URL.Path[sepIndex+len("/manifests/"):], "-", 2)[0])
+		}
+	}
+	assert.Equal(t, []string{"feature", "master", "develop"}, order)
+}
+
+func TestRegistryGetRepositoryInNamespaces(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"env1/api": {
+			"1500000000-abcdef": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+		"env2/api": {
+			"1500000100-bcdef0": "sha256:a1b2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:        server.URL,
+		Namespace:      "airware",
+		MaxConcurrency: 1,
+	}}
+	images, err := testService.GetRepositoryInNamespaces([]string{"env1", "env2", "env3"}, "api", []string{"master"})
+	assert.IsType(t, RepositoriesError{}, err)
+	assert.Contains(t, err.(RepositoriesError), "env3/api")
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, "1500000100-bcdef0", images[0].Tag)
+		assert.Equal(t, "env2", images[0].Namespace)
+		assert.Equal(t, "1500000000-abcdef", images[1].Tag)
+		assert.Equal(t, "env1", images[1].Namespace)
+	}
+}
+
+func TestRegistryUnknownErrors(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	_, err := testService.GetTag("vili", "missing")
+	assert.True(t, errors.Is(err, ErrTagUnknown), "%v", err)
+	_, err = testService.GetTag("missing", "master")
+	assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+
+	exists, err := testService.Exists("vili", "missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = testService.Exists("missing", "master")
+	assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+	assert.False(t, exists)
+
+	_, err = testService.GetRepository("missing", []string{"master"})
+	assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+	_, err = testService.ListTags(context.Background(), "missing", 0, nil)
+	assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+}
+
+func TestRegistryUnknownTagProbes(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": testDigest("a")},
+	})
+	defer server.Close()
+	manifestGets := func() int {
+		reg.mutex.Lock()
+		defer reg.mutex.Unlock()
+		gets := 0
+		for _, r := range reg.requests {
+			if r.Method == "GET" && strings.Contains(r.URL.Path, "/manifests/") {
+				gets++
+			}
+		}
+		return gets
+	}
+
+	// a HEAD miss is probed with GET until the repository is known to exist
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	for i := 0; i < 3; i++ {
+		exists, err := testService.Exists("vili", "missing")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	}
+	assert.Equal(t, 1, manifestGets())
+	_, err := testService.GetTag("vili", "missing")
+	assert.True(t, errors.Is(err, ErrTagUnknown), "%v", err)
+	assert.Equal(t, 1, manifestGets())
+
+	// unknown repositories are still told apart
+	for i := 0; i < 2; i++ {
+		_, err = testService.Exists("missing", "master")
+		assert.True(t, errors.Is(err, ErrRepositoryUnknown), "%v", err)
+	}
+
+	// the error code of a response with an error body is used without probing
+	err = testService.manifestUnknownError("other", "missing", errcode.Errors{v2.ErrorCodeManifestUnknown})
+	assert.True(t, errors.Is(err, ErrTagUnknown), "%v", err)
+	assert.Equal(t, 3, manifestGets())
+}
+
+func TestRegistryNotARegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	_, err := testService.GetTag("vili", "master")
+	assert.True(t, errors.Is(err, ErrNotARegistry))
+
+	reg, registryServer := newTestRegistry(map[string]map[string]string{"vili": {"master": "sha256:abcdef"}})
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+	defer registryServer.Close()
+	resp, err := http.Get(registryServer.URL + "/v2/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	resp.Header.Del("Docker-Distribution-API-Version")
+	assert.True(t, isRegistryResponse(resp))
 }
@@ -1,6 +1,8 @@
 package repository
 
 import (
+	"errors"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -8,14 +10,109 @@ import (
 
 // Image represents an image in a repository
 type Image struct {
-	Tag          string    `json:"tag"`
-	Branch       string    `json:"branch"`
-	Revision     string    `json:"revision"`
-	LastModified time.Time `json:"lastModified"`
+	Registry      string    `json:"registry,omitempty"`
+	Namespace     string    `json:"namespace,omitempty"`
+	Tag           string    `json:"tag"`
+	Branch        string    `json:"branch"`
+	Branches      []string  `json:"branches,omitempty"`
+	Revision      string    `json:"revision"`
+	ShortRevision string    `json:"shortRevision,omitempty"`
+	LastModified  time.Time `json:"lastModified"`
+	Arch          string    `json:"arch,omitempty"`
+	Digest        string    `json:"digest,omitempty"`
+	MediaType     string    `json:"mediaType,omitempty"`
+	SchemaVersion int       `json:"schemaVersion,omitempty"`
+
+	// IndexDigest is the digest of the manifest list holding the image, when its
+	// Digest was resolved to a platform with PlatformDigests
+	IndexDigest string `json:"indexDigest,omitempty"`
+	// ShortDigest is the abbreviated Digest, when ShortDigestLength is set
+	ShortDigest string `json:"shortDigest,omitempty"`
+
+	// LastPulled and Immutable are reported by the registry's vendor API
+	// when FetchTagMetadata is set
+	LastPulled *time.Time `json:"lastPulled,omitempty"`
+	Immutable  bool       `json:"immutable,omitempty"`
 }
 
+// SortOrder is the order in which images are returned
+type SortOrder string
+
+// Sort orders
+const (
+	// SortLastModified returns the most recently modified images first
+	SortLastModified SortOrder = ""
+	// SortNone returns images in the order the registry listed their tags, grouped
+	// by branch in the order the branches were requested
+	SortNone SortOrder = "none"
+	// SortSemver returns the images with the highest semantic version tags first,
+	// followed by the images whose tags are not semantic versions. Semantic version
+	// tags, such as v1.2.0 or 1.2.0-rc.1, are listed when tags are not branch-prefixed.
+	SortSemver SortOrder = "semver"
+)
+
+// BranchStats records the outcome of fetching the images for a branch
+type BranchStats struct {
+	// Tags is the number of tags listed in the repository
+	Tags int
+	// Skipped is the number of tags that were skipped because they do not belong
+	// to the branch or do not match the tag format
+	Skipped int
+	// Unparseable is the number of the skipped tags that do not match the tag format
+	Unparseable int
+	// Duplicates is the number of tags that were ignored because the registry had
+	// already listed them
+	Duplicates int
+	Duration   time.Duration
+	Err        error
+	// Outstanding is whether the fetch of the branch was cancelled, or never started,
+	// because MinBranchesSuccess other branches had been fetched
+	Outstanding bool
+}
+
+// RepositoryResult holds the images fetched for a repository along with the fetch
+// stats of each branch
+type RepositoryResult struct {
+	Images   []*Image
+	Branches map[string]*BranchStats
+	// Outstanding holds the sorted branches that were still outstanding when
+	// MinBranchesSuccess branches had been fetched
+	Outstanding []string
+}
+
+// ErrorPolicy determines how branch fetch errors are reported
+type ErrorPolicy string
+
+// Error policies
+const (
+	// FailOnEmpty fails if a branch failed and no images were found in the others,
+	// with a BranchesError if every branch failed
+	FailOnEmpty ErrorPolicy = ""
+	// FailOnAny fails if any branch failed
+	FailOnAny ErrorPolicy = "any"
+	// FailOnAll fails only if every branch failed
+	FailOnAll ErrorPolicy = "all"
+	// ErrorPolicyCollect returns the images of the successful branches along with
+	// the errors of the failed branches
+	ErrorPolicyCollect ErrorPolicy = "collect"
+)
+
+// FuturePolicy determines how listings handle images timestamped in the future
+type FuturePolicy string
+
+// Future policies
+const (
+	// FutureKeep keeps future timestamps as is, so those images sort as the newest
+	FutureKeep FuturePolicy = ""
+	// FutureSkip drops images with future timestamps from listings
+	FutureSkip FuturePolicy = "skip"
+	// FutureClamp clamps future timestamps to the time of the listing
+	FutureClamp FuturePolicy = "clamp"
+)
+
 type getImagesResult struct {
 	images []*Image
+	stats  *BranchStats
 	err    error
 }
 
@@ -40,6 +137,28 @@ func (s *imageSorter) Less(i, j int) bool {
 	return s.by(s.images[i], s.images[j])
 }
 
+// limiter bounds the number of concurrent operations. A nil limiter is unbounded.
+type limiter chan struct{}
+
+func newLimiter(size int) limiter {
+	if size <= 0 {
+		return nil
+	}
+	return make(limiter, size)
+}
+
+func (l limiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
 func slugFromBranch(branch string) string {
 	return strings.ToLower(strings.Replace(branch, "/", "-", -1))
 }
@@ -54,6 +173,66 @@ func sortByLastModified(images []*Image) {
 	sort.Sort(ps)
 }
 
+// ErrNotARegistry is raised when the registry URL does not serve the docker registry v2 API
+var ErrNotARegistry = errors.New("URL does not serve the docker registry v2 API, check the registry URL")
+
+// ErrUnauthorized is raised when the registry rejects the configured credentials
+var ErrUnauthorized = errors.New("registry rejected the credentials, check the username and password")
+
+// ErrUnreachable is raised when the registry cannot be connected to
+var ErrUnreachable = errors.New("registry could not be reached, check the network connection")
+
+// ErrRepositoryUnknown is raised when the registry does not know the repository
+var ErrRepositoryUnknown = errors.New("repository is not known to the registry")
+
+// ErrTagUnknown is raised when the registry knows the repository but not the tag
+var ErrTagUnknown = errors.New("tag is not known to the registry")
+
+// ErrRegistryNotAllowed is raised when an image reference would point at a registry
+// that is not in AllowedRegistries
+var ErrRegistryNotAllowed = errors.New("registry is not in the allowed registries")
+
+// defaultTag is the tag used when none is given, as with the docker CLI
+const defaultTag = "latest"
+
+// ErrMissingTag is raised when no tag is given and RequireTag is set
+var ErrMissingTag = errors.New("image tag is required")
+
+// ErrSchema1Manifest is raised when a manifest is in the deprecated schema1 format and
+// AllowSchema1 is not set
+var ErrSchema1Manifest = errors.New("manifest is in the deprecated schema1 format, set AllowSchema1 to inspect it")
+
+// dedupeImages collapses images with the same digest into the first of them,
+// recording all of the branches the digest appears under
+func dedupeImages(images []*Image) []*Image {
+	var deduped []*Image
+	byDigest := make(map[string]*Image)
+	for _, image := range images {
+		if image.Digest == "" {
+			deduped = append(deduped, image)
+			continue
+		}
+		first, ok := byDigest[image.Digest]
+		if !ok {
+			image.Branches = []string{image.Branch}
+			byDigest[image.Digest] = image
+			deduped = append(deduped, image)
+			continue
+		}
+		found := false
+		for _, branch := range first.Branches {
+			if branch == image.Branch {
+				found = true
+				break
+			}
+		}
+		if !found {
+			first.Branches = append(first.Branches, image.Branch)
+		}
+	}
+	return deduped
+}
+
 // NotFoundError is raised when a given repository or image tag is not found
 type NotFoundError struct {
 }
@@ -61,3 +240,129 @@ type NotFoundError struct {
 func (e *NotFoundError) Error() string {
 	return "Repository image not found"
 }
+
+// InvalidDigestError is raised when a digest is malformed or uses an unsupported algorithm
+type InvalidDigestError struct {
+	Digest string
+	Err    error
+}
+
+func (e *InvalidDigestError) Error() string {
+	return fmt.Sprintf("Invalid digest %q: %s", e.Digest, e.Err)
+}
+
+func (e *InvalidDigestError) Unwrap() error {
+	return e.Err
+}
+
+// ManifestTooLargeError is raised when a manifest exceeds the maximum manifest size
+type ManifestTooLargeError struct {
+	Limit int64
+}
+
+func (e *ManifestTooLargeError) Error() string {
+	return fmt.Sprintf("Manifest exceeds the maximum size of %d bytes", e.Limit)
+}
+
+// TransferLimitError is raised when an operation downloads more than MaxBytesPerOp bytes
+type TransferLimitError struct {
+	Limit int64
+}
+
+func (e *TransferLimitError) Error() string {
+	return fmt.Sprintf("Operation exceeded the transfer limit of %d bytes", e.Limit)
+}
+
+// ListCancelledError is raised when a tag listing is cancelled before it completes.
+// The tags listed before it was cancelled are returned along with it.
+type ListCancelledError struct {
+	Tags int
+	Err  error
+}
+
+func (e *ListCancelledError) Error() string {
+	return fmt.Sprintf("Tag listing cancelled after %d tags: %v", e.Tags, e.Err)
+}
+
+// Unwrap returns the context error that cancelled the listing
+func (e *ListCancelledError) Unwrap() error {
+	return e.Err
+}
+
+// RepositoriesError is raised when one or more repositories could not be fetched.
+// It maps each failed repository to its error.
+type RepositoriesError map[string]error
+
+func (e RepositoriesError) Error() string {
+	repos := make([]string, 0, len(e))
+	for repo := range e {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return fmt.Sprintf("Failed to fetch repositories: %s", strings.Join(repos, ", "))
+}
+
+// BranchesError is raised when one or more branches of a repository could not be
+// fetched. It maps each failed branch to its error.
+type BranchesError map[string]error
+
+func (e BranchesError) Error() string {
+	branches := make([]string, 0, len(e))
+	for branch := range e {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	return fmt.Sprintf("Failed to fetch branches: %s", strings.Join(branches, ", "))
+}
+
+// Unwrap returns the errors of the failed branches, ordered by branch
+func (e BranchesError) Unwrap() []error {
+	branches := make([]string, 0, len(e))
+	for branch := range e {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+	errs := make([]error, 0, len(e))
+	for _, branch := range branches {
+		errs = append(errs, e[branch])
+	}
+	return errs
+}
+
+// TagsError is raised when one or more tags could not be checked.
+// It maps each failed tag to its error.
+type TagsError map[string]error
+
+func (e TagsError) Error() string {
+	tags := make([]string, 0, len(e))
+	for tag := range e {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("Failed to check tags: %s", strings.Join(tags, ", "))
+}
+
+// ArtifactError is raised when the image config of a manifest is needed but the
+// manifest is an artifact other than an image, such as an SBOM or a Helm chart
+type ArtifactError struct {
+	Repo         string
+	Ref          string
+	ArtifactType string
+}
+
+func (e *ArtifactError) Error() string {
+	return fmt.Sprintf("Manifest for %s:%s is a %s artifact, not an image", e.Repo, e.Ref, e.ArtifactType)
+}
+
+// RateLimitedError is raised when the registry rejects a request with 429 Too Many Requests
+type RateLimitedError struct {
+	// RetryAfter is the delay requested by the registry, or zero if none was given
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Registry rate limit exceeded, retry after %s", e.RetryAfter)
+	}
+	return "Registry rate limit exceeded"
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID sent in the RequestIDHeader of
+// registry requests made with it. Retries made with the same context share the ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by the context, or "" if there is none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDTransport is an http.RoundTripper that sets a request ID header on every
+// request, from the request's context or newly generated
+type requestIDTransport struct {
+	base   http.RoundTripper
+	header string
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(t.header) != "" {
+		return t.base.RoundTrip(req)
+	}
+	id := RequestIDFromContext(req.Context())
+	if id == "" {
+		id = newRequestID()
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, id)
+	return t.base.RoundTrip(req)
+}
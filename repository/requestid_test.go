@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryRequestID(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": testDigest("master")},
+	})
+	defer server.Close()
+	reg.basicAuth = "Basic dXNlcjpwYXNz"
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:         server.URL,
+		Username:        "user",
+		Password:        "pass",
+		RequestIDHeader: "X-Request-ID",
+	}}
+	ctx := WithRequestID(context.Background(), "op-1")
+	assert.Equal(t, "op-1", RequestIDFromContext(ctx))
+	assert.NoError(t, testService.Warmup(ctx, "vili"))
+	assert.NotEmpty(t, reg.requests)
+	for _, req := range reg.requests {
+		assert.Equal(t, "op-1", req.Header.Get("X-Request-ID"))
+	}
+
+	reg.requests = nil
+	_, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reg.requests)
+	for _, req := range reg.requests {
+		assert.Len(t, req.Header.Get("X-Request-ID"), 32)
+	}
+}
@@ -0,0 +1,312 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/distribution/registry/client"
+)
+
+// RetryConfig is the retrying service configuration
+type RetryConfig struct {
+	// MaxRetries is the maximum number of times a failed read is retried
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry, doubled for each
+	// subsequent retry. Defaults to 500ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. Defaults to 30s.
+	MaxBackoff time.Duration
+	// Backoff, if set, determines the delay between retries instead of
+	// InitialBackoff and MaxBackoff
+	Backoff Backoff
+	// RetryBudget, if set, caps the retries available to all operations of the
+	// service, so that many failing operations cannot multiply the load on the
+	// registry. Failed operations are not retried while the budget is exhausted.
+	RetryBudget int
+	// RetryBudgetRefill is the interval at which one retry is returned to the
+	// budget. Defaults to 1s.
+	RetryBudgetRefill time.Duration
+}
+
+// retryBudget is a token bucket of retries shared between operations
+type retryBudget struct {
+	mutex  sync.Mutex
+	max    float64
+	tokens float64
+	refill time.Duration
+	last   time.Time
+}
+
+// newRetryBudget returns a full budget of max retries, refilling one retry per interval
+func newRetryBudget(max int, refill time.Duration) *retryBudget {
+	if refill <= 0 {
+		refill = time.Second
+	}
+	return &retryBudget{
+		max:    float64(max),
+		tokens: float64(max),
+		refill: refill,
+		last:   time.Now(),
+	}
+}
+
+// take consumes a retry from the budget, returning false if it is exhausted
+func (b *retryBudget) take() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += float64(now.Sub(b.last)) / float64(b.refill)
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Backoff determines the delay before retrying a failed operation
+type Backoff interface {
+	// NextDelay returns the delay before the given retry, starting from zero
+	NextDelay(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same delay before every retry
+type ConstantBackoff time.Duration
+
+// NextDelay implements the Backoff interface
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff doubles the delay before each retry, starting from Initial and
+// capped at Max, jittering each delay between half and all of the backoff
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// NextDelay implements the Backoff interface
+func (b *ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.ceiling(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ceiling returns the un-jittered delay before the given retry
+func (b *ExponentialBackoff) ceiling(attempt int) time.Duration {
+	delay := b.Initial << uint(attempt)
+	if delay <= 0 || delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// FullJitterBackoff doubles the delay before each retry like ExponentialBackoff,
+// but jitters each delay between zero and all of the backoff
+type FullJitterBackoff ExponentialBackoff
+
+// NextDelay implements the Backoff interface
+func (b *FullJitterBackoff) NextDelay(attempt int) time.Duration {
+	delay := (*ExponentialBackoff)(b).ceiling(attempt)
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// TagReader is a service whose tag reads, besides those of the docker Service
+// interface, can be retried by a RetryingService. RegistryService implements it.
+type TagReader interface {
+	ExistsContext(ctx context.Context, repo, tag string) (bool, error)
+	ListTags(ctx context.Context, repo string, pageSize int, progress func(ListProgress)) ([]string, error)
+}
+
+// RetryingService is an implementation of the docker Service interface
+// It wraps another Service and retries its reads on transient failures. Exists and
+// ListTags are retried if the wrapped service is a TagReader, and fail with an error
+// wrapping errors.ErrUnsupported otherwise.
+type RetryingService struct {
+	service DockerService
+	config  *RetryConfig
+	budget  *retryBudget
+}
+
+// NewRetryingService returns a service that retries the reads of the given service
+func NewRetryingService(service DockerService, c *RetryConfig) *RetryingService {
+	s := &RetryingService{
+		service: service,
+		config:  c,
+	}
+	if c.RetryBudget > 0 {
+		s.budget = newRetryBudget(c.RetryBudget, c.RetryBudgetRefill)
+	}
+	return s
+}
+
+// GetRepository implements the Service interface
+func (s *RetryingService) GetRepository(repo string, branches []string) ([]*Image, error) {
+	return s.GetRepositoryContext(context.Background(), repo, branches)
+}
+
+// GetRepositoryContext fetches the images like GetRepository, no longer retrying once
+// the context is done
+func (s *RetryingService) GetRepositoryContext(ctx context.Context, repo string, branches []string) (images []*Image, err error) {
+	err = s.retry(ctx, func() error {
+		images, err = s.service.GetRepository(repo, branches)
+		return err
+	})
+	return
+}
+
+// GetTag implements the Service interface
+func (s *RetryingService) GetTag(repo, tag string) (string, error) {
+	return s.GetTagContext(context.Background(), repo, tag)
+}
+
+// GetTagContext returns the digest of the tag like GetTag, no longer retrying once the
+// context is done
+func (s *RetryingService) GetTagContext(ctx context.Context, repo, tag string) (digest string, err error) {
+	err = s.retry(ctx, func() error {
+		digest, err = s.service.GetTag(repo, tag)
+		return err
+	})
+	return
+}
+
+// Exists returns whether the tag exists in the repository, retrying like GetTag
+func (s *RetryingService) Exists(repo, tag string) (bool, error) {
+	return s.ExistsContext(context.Background(), repo, tag)
+}
+
+// ExistsContext returns whether the tag exists like Exists, no longer retrying once the
+// context is done
+func (s *RetryingService) ExistsContext(ctx context.Context, repo, tag string) (exists bool, err error) {
+	reader, err := s.tagReader("Exists")
+	if err != nil {
+		return false, err
+	}
+	err = s.retry(ctx, func() error {
+		exists, err = reader.ExistsContext(ctx, repo, tag)
+		return err
+	})
+	return
+}
+
+// ListTags lists the repository's tags, retrying the whole listing on transient
+// failures. The progress of a retried listing starts over.
+func (s *RetryingService) ListTags(ctx context.Context, repo string, pageSize int, progress func(ListProgress)) (tags []string, err error) {
+	reader, err := s.tagReader("ListTags")
+	if err != nil {
+		return nil, err
+	}
+	err = s.retry(ctx, func() error {
+		tags, err = reader.ListTags(ctx, repo, pageSize, progress)
+		return err
+	})
+	return
+}
+
+// tagReader returns the wrapped service as a TagReader, or an error naming the method
+// if it isn't one
+func (s *RetryingService) tagReader(method string) (TagReader, error) {
+	reader, ok := s.service.(TagReader)
+	if !ok {
+		return nil, fmt.Errorf("%s of %T: %w", method, s.service, errors.ErrUnsupported)
+	}
+	return reader, nil
+}
+
+// FullName implements the Service interface
+func (s *RetryingService) FullName(repo, tag string) (string, error) {
+	return s.service.FullName(repo, tag)
+}
+
+// retry calls f until it succeeds, fails with an error that is not transient,
+// has been retried MaxRetries times, or the retry budget is exhausted. If the
+// context is done while waiting to retry, its error is returned.
+func (s *RetryingService) retry(ctx context.Context, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= s.config.MaxRetries || !isTransient(err) {
+			return err
+		}
+		if s.budget != nil && !s.budget.take() {
+			return err
+		}
+		timer := time.NewTimer(s.retryDelay(err, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay returns the delay before retrying an operation that failed with the
+// given error, honoring the registry's requested delay when rate limited
+func (s *RetryingService) retryDelay(err error, attempt int) time.Duration {
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) && rateLimited.RetryAfter > 0 {
+		return rateLimited.RetryAfter
+	}
+
+	if s.config.Backoff != nil {
+		return s.config.Backoff.NextDelay(attempt)
+	}
+	backoff := &ExponentialBackoff{Initial: s.config.InitialBackoff, Max: s.config.MaxBackoff}
+	if backoff.Initial <= 0 {
+		backoff.Initial = 500 * time.Millisecond
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = 30 * time.Second
+	}
+	return backoff.NextDelay(attempt)
+}
+
+// isTransient returns true if the error may succeed when the operation is retried:
+// rate limiting, server errors, timeouts and refused or reset connections. Other
+// errors, such as client errors and certificate or DNS failures, are not retried.
+func isTransient(err error) bool {
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) {
+		return true
+	}
+	var statusErr *client.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) {
+		return isTransientStatus(statusCode(statusErr.Status))
+	}
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) {
+		return isTransientStatus(responseErr.StatusCode)
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isTransientStatus returns whether a response with the HTTP status code may succeed
+// when retried
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// statusCode returns the code of an HTTP status such as "503 Service Unavailable",
+// or zero if it has none
+func statusCode(status string) int {
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return code
+}
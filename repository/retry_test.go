@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyService is a docker service that fails a fixed number of times before succeeding
+type flakyService struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyService) GetRepository(repo string, branches []string) ([]*Image, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, s.err
+	}
+	return []*Image{{Tag: "1500000000-abcdef"}}, nil
+}
+
+func (s *flakyService) GetTag(repo, tag string) (string, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return "", s.err
+	}
+	return "sha256:abcdef", nil
+}
+
+func (s *flakyService) FullName(repo, tag string) (string, error) {
+	s.calls++
+	return repo + ":" + tag, nil
+}
+
+func TestRetryingService(t *testing.T) {
+	flaky := &flakyService{failures: 2, err: &RateLimitedError{RetryAfter: time.Millisecond}}
+	testService := NewRetryingService(flaky, &RetryConfig{MaxRetries: 3})
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky = &flakyService{failures: 5, err: &RateLimitedError{}}
+	testService = NewRetryingService(flaky, &RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond})
+	_, err = testService.GetTag("vili", "master")
+	assert.IsType(t, &RateLimitedError{}, err)
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky = &flakyService{failures: 1, err: errors.New("manifest unknown")}
+	testService = NewRetryingService(flaky, &RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond})
+	_, err = testService.GetTag("vili", "master")
+	assert.Error(t, err)
+	assert.Equal(t, 1, flaky.calls)
+}
+
+// flakyReader is a flaky service whose tag reads also fail a fixed number of times
+type flakyReader struct {
+	flakyService
+}
+
+func (s *flakyReader) ExistsContext(ctx context.Context, repo, tag string) (bool, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return false, s.err
+	}
+	return true, nil
+}
+
+func (s *flakyReader) ListTags(ctx context.Context, repo string, pageSize int, progress func(ListProgress)) ([]string, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, s.err
+	}
+	return []string{"1500000000-abcdef"}, nil
+}
+
+func TestRetryingServiceTagReads(t *testing.T) {
+	assert.Implements(t, (*TagReader)(nil), &RegistryService{})
+
+	flaky := &flakyReader{flakyService{failures: 2, err: &RateLimitedError{RetryAfter: time.Millisecond}}}
+	testService := NewRetryingService(flaky, &RetryConfig{MaxRetries: 3})
+	exists, err := testService.Exists("vili", "1500000000-abcdef")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky.calls = 0
+	tags, err := testService.ListTags(context.Background(), "vili", 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1500000000-abcdef"}, tags)
+	assert.Equal(t, 3, flaky.calls)
+
+	testService = NewRetryingService(&flakyService{}, &RetryConfig{MaxRetries: 3})
+	_, err = testService.Exists("vili", "1500000000-abcdef")
+	assert.True(t, errors.Is(err, errors.ErrUnsupported), "%v", err)
+	_, err = testService.ListTags(context.Background(), "vili", 0, nil)
+	assert.True(t, errors.Is(err, errors.ErrUnsupported), "%v", err)
+}
+
+func TestRetryingServiceContext(t *testing.T) {
+	flaky := &flakyService{failures: 5, err: &RateLimitedError{RetryAfter: time.Hour}}
+	testService := NewRetryingService(flaky, &RetryConfig{MaxRetries: 3})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := testService.GetTagContext(ctx, "vili", "master")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, flaky.calls)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, testCase := range []struct {
+		err       error
+		transient bool
+	}{
+		{&RateLimitedError{}, true},
+		{&client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}, true},
+		{&client.UnexpectedHTTPStatusError{Status: "404 Not Found"}, false},
+		{&client.UnexpectedHTTPResponseError{StatusCode: http.StatusTooManyRequests}, true},
+		{&client.UnexpectedHTTPResponseError{StatusCode: http.StatusForbidden}, false},
+		{&url.Error{Op: "Get", URL: "https://registry", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{&url.Error{Op: "Get", URL: "https://registry", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{&url.Error{Op: "Get", URL: "https://registry", Err: &net.DNSError{Err: "timeout", IsTimeout: true}}, true},
+		{&url.Error{Op: "Get", URL: "https://registry", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "https://registry", Err: errors.New("x509: certificate signed by unknown authority")}, false},
+		{errors.New("manifest unknown"), false},
+	} {
+		assert.Equal(t, testCase.transient, isTransient(testCase.err), "%v", testCase.err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	testService := NewRetryingService(&flakyService{}, &RetryConfig{
+		MaxRetries:        3,
+		InitialBackoff:    time.Millisecond,
+		RetryBudget:       4,
+		RetryBudgetRefill: time.Hour,
+	})
+
+	flaky := &flakyService{failures: 10, err: &RateLimitedError{}}
+	testService.service = flaky
+	_, err := testService.GetTag("vili", "master")
+	assert.IsType(t, &RateLimitedError{}, err)
+	assert.Equal(t, 4, flaky.calls)
+
+	// the remaining retry is shared with the next operation
+	flaky = &flakyService{failures: 10, err: &RateLimitedError{}}
+	testService.service = flaky
+	_, err = testService.GetRepository("vili", []string{"master"})
+	assert.IsType(t, &RateLimitedError{}, err)
+	assert.Equal(t, 2, flaky.calls)
+
+	// once exhausted, failures are returned without retrying
+	flaky = &flakyService{failures: 10, err: &RateLimitedError{}}
+	testService.service = flaky
+	_, err = testService.GetTag("vili", "master")
+	assert.IsType(t, &RateLimitedError{}, err)
+	assert.Equal(t, 1, flaky.calls)
+
+	budget := newRetryBudget(1, time.Millisecond)
+	assert.True(t, budget.take())
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, budget.take())
+}
+
+func TestRegistryRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	_, err := testService.GetTag("vili", "master")
+	var rateLimited *RateLimitedError
+	assert.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, 7*time.Second, rateLimited.RetryAfter)
+	assert.True(t, isTransient(err))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, ConstantBackoff(time.Second).NextDelay(5))
+
+	exponential := &ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second}
+	for attempt, ceiling := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := exponential.NextDelay(attempt)
+		assert.True(t, delay >= ceiling/2 && delay <= ceiling, "attempt %d: %s", attempt, delay)
+	}
+
+	fullJitter := &FullJitterBackoff{Initial: time.Second, Max: 10 * time.Second}
+	for attempt := 0; attempt < 6; attempt++ {
+		delay := fullJitter.NextDelay(attempt)
+		assert.True(t, delay >= 0 && delay <= 10*time.Second, "attempt %d: %s", attempt, delay)
+	}
+
+	flaky := &flakyService{failures: 2, err: &RateLimitedError{}}
+	testService := NewRetryingService(flaky, &RetryConfig{MaxRetries: 2, Backoff: ConstantBackoff(time.Millisecond)})
+	start := time.Now()
+	_, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// semverPattern matches semantic versions, optionally prefixed with v, as in v1.2.0-rc.1+build.5
+var semverPattern = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+// semver is a parsed semantic version. Build metadata is not kept, as it does not
+// affect precedence.
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// parseSemver parses a semantic version tag, returning false if it is not valid
+func parseSemver(tag string) (semver, bool) {
+	match := semverPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return semver{}, false
+	}
+	var version semver
+	var err error
+	for i, field := range []*uint64{&version.major, &version.minor, &version.patch} {
+		if *field, err = strconv.ParseUint(match[i+1], 10, 64); err != nil {
+			return semver{}, false
+		}
+	}
+	if match[4] != "" {
+		version.prerelease = strings.Split(match[4], ".")
+	}
+	return version, true
+}
+
+// compareSemver returns -1, 0 or 1 if a has lower, equal or higher precedence than b
+func compareSemver(a, b semver) int {
+	for _, fields := range [][2]uint64{{a.major, b.major}, {a.minor, b.minor}, {a.patch, b.patch}} {
+		if fields[0] != fields[1] {
+			if fields[0] < fields[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// a release has higher precedence than its prereleases
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+		if c := comparePrereleaseIdentifier(a.prerelease[i], b.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a.prerelease) < len(b.prerelease):
+		return -1
+	case len(a.prerelease) > len(b.prerelease):
+		return 1
+	}
+	return 0
+}
+
+// comparePrereleaseIdentifier compares prerelease identifiers: numeric identifiers
+// numerically, alphanumeric identifiers lexically, and numeric identifiers lower
+func comparePrereleaseIdentifier(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// semverLess returns whether tag a sorts before tag b when ordered by descending
+// semver precedence, that is whether a has the higher precedence, with tags that are
+// not semantic versions last. It returns ok false if neither tag orders before the
+// other.
+func semverLess(a, b string) (less bool, ok bool) {
+	aVersion, aValid := parseSemver(a)
+	bVersion, bValid := parseSemver(b)
+	switch {
+	case aValid && bValid:
+		c := compareSemver(aVersion, bVersion)
+		return c > 0, c != 0
+	case aValid != bValid:
+		return aValid, true
+	}
+	return false, false
+}
+
+// sortBySemver sorts images by descending semver precedence of their tags, with images
+// whose tags are not semantic versions last. Images of equal precedence are sorted
+// with the most recently modified first.
+func sortBySemver(images []*Image) {
+	ps := &imageSorter{
+		images: images,
+		by: func(i1, i2 *Image) bool {
+			if less, ok := semverLess(i1.Tag, i2.Tag); ok {
+				return less
+			}
+			return i1.LastModified.After(i2.LastModified)
+		},
+	}
+	sort.Sort(ps)
+}
+
+// SortSemverTags sorts tags by descending semver precedence, so that the highest
+// version is first, with tags that are not semantic versions last in lexical order
+func SortSemverTags(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		if less, ok := semverLess(tags[i], tags[j]); ok {
+			return less
+		}
+		return tags[i] < tags[j]
+	})
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareSemver(t *testing.T) {
+	// in ascending order of precedence, per the semver specification
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"v1.0.0",
+		"1.0.1",
+		"1.2.0-rc.1",
+		"1.2.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, ok := parseSemver(ordered[i])
+			assert.True(t, ok, ordered[i])
+			b, _ := parseSemver(ordered[j])
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			assert.Equal(t, expected, compareSemver(a, b), "%s <=> %s", ordered[i], ordered[j])
+		}
+	}
+
+	a, _ := parseSemver("1.2.0+build.1")
+	b, _ := parseSemver("1.2.0+build.2")
+	assert.Equal(t, 0, compareSemver(a, b))
+
+	for _, invalid := range []string{"1.2", "01.2.0", "1.2.0-01", "1.2.0-", "1.2.0+", "latest", "1500000000-abcdef"} {
+		_, ok := parseSemver(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestSortSemverTags(t *testing.T) {
+	tags := []string{"latest", "v1.2.0-rc.1", "v1.10.0", "v1.2.0", "master", "v1.2.0-rc.2+build.7", "v1.9.9"}
+	SortSemverTags(tags)
+	assert.Equal(t, []string{"v1.10.0", "v1.9.9", "v1.2.0", "v1.2.0-rc.2+build.7", "v1.2.0-rc.1", "latest", "master"}, tags)
+}
+
+func TestRegistrySortSemver(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"v1.2.0-rc.1":       testDigest("a"),
+			"v1.2.0":            testDigest("b"),
+			"v1.10.0":           testDigest("c"),
+			"1500000000-abcdef": testDigest("d"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, SortOrder: SortSemver}}
+	images, err := testService.GetRepository("vili", nil)
+	assert.NoError(t, err)
+	var tags []string
+	for _, image := range images {
+		tags = append(tags, image.Tag)
+	}
+	assert.Equal(t, []string{"v1.10.0", "v1.2.0", "v1.2.0-rc.1", "1500000000-abcdef"}, tags)
+}
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// snapshotVersion is the version of the serialized snapshot format
+const snapshotVersion = 1
+
+// RepositorySnapshot is a point-in-time record of the images in a repository
+type RepositorySnapshot struct {
+	Registry   string
+	Repository string
+	Branches   []string
+	FetchedAt  time.Time
+	Images     []*Image
+}
+
+// snapshotJSON is the serialized form of a RepositorySnapshot
+type snapshotJSON struct {
+	Version    int      `json:"version"`
+	Registry   string   `json:"registry"`
+	Repository string   `json:"repository"`
+	Branches   []string `json:"branches"`
+	FetchedAt  string   `json:"fetchedAt"`
+	Images     []*Image `json:"images"`
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (s *RepositorySnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&snapshotJSON{
+		Version:    snapshotVersion,
+		Registry:   s.Registry,
+		Repository: s.Repository,
+		Branches:   s.Branches,
+		FetchedAt:  s.FetchedAt.UTC().Format(time.RFC3339Nano),
+		Images:     s.Images,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (s *RepositorySnapshot) UnmarshalJSON(data []byte) error {
+	var snapshot snapshotJSON
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("unsupported repository snapshot version %d", snapshot.Version)
+	}
+	fetchedAt, err := time.Parse(time.RFC3339Nano, snapshot.FetchedAt)
+	if err != nil {
+		return err
+	}
+	*s = RepositorySnapshot{
+		Registry:   snapshot.Registry,
+		Repository: snapshot.Repository,
+		Branches:   snapshot.Branches,
+		FetchedAt:  fetchedAt,
+		Images:     snapshot.Images,
+	}
+	return nil
+}
+
+// SnapshotRepository fetches the images in the repository for the given branches
+// and records them in a snapshot
+func (s *RegistryService) SnapshotRepository(repo string, branches []string) (*RepositorySnapshot, error) {
+	fetchedAt := s.now()
+	images, err := s.GetRepository(repo, branches)
+	if err != nil {
+		return nil, err
+	}
+	return &RepositorySnapshot{
+		Registry:   s.pullDomain(),
+		Repository: s.fullRepositoryName(repo),
+		Branches:   branches,
+		FetchedAt:  fetchedAt,
+		Images:     images,
+	}, nil
+}
+
+// SnapshotDiff is the difference between two repository snapshots. Images are matched
+// by branch and tag, and each list is sorted by branch and then tag.
+type SnapshotDiff struct {
+	// Added are the images only in the new snapshot
+	Added []*Image
+	// Removed are the images only in the old snapshot
+	Removed []*Image
+	// Changed are the tags that were retagged to a different digest
+	Changed []*ImageChange
+	// Conflicts are the retagged tags, when diffing with ConflictReport
+	Conflicts []*ImageChange
+	// Unchanged are the images in both snapshots, from the new snapshot unless
+	// ConflictLatest kept the old image
+	Unchanged []*Image
+	// Branches are the sorted branches with added, removed or changed images
+	Branches []string
+}
+
+// ImageChange is a tag that points at a different image in the new snapshot
+type ImageChange struct {
+	Old *Image
+	New *Image
+}
+
+// ConflictPolicy determines how DiffSnapshotsWithPolicy reports tags that were
+// retagged to a different digest
+type ConflictPolicy string
+
+// Conflict policies
+const (
+	// ConflictChanged reports retagged tags as changed
+	ConflictChanged ConflictPolicy = ""
+	// ConflictReport reports retagged tags as conflicts, for environments where tags
+	// are expected to be immutable
+	ConflictReport ConflictPolicy = "conflict"
+	// ConflictLatest keeps the image that was modified last. A retagged tag is
+	// reported as changed if the new image was modified last, and as unchanged with
+	// the old image otherwise.
+	ConflictLatest ConflictPolicy = "latest"
+)
+
+// snapshotKey identifies an image across snapshots
+type snapshotKey struct {
+	branch string
+	tag    string
+}
+
+// DiffSnapshots returns the images added, removed and retagged between the old and the
+// new snapshot. A tag is only considered retagged if both snapshots resolved its digest,
+// and retagged tags are reported as changed.
+func DiffSnapshots(oldSnapshot, newSnapshot RepositorySnapshot) SnapshotDiff {
+	return DiffSnapshotsWithPolicy(oldSnapshot, newSnapshot, ConflictChanged)
+}
+
+// DiffSnapshotsWithPolicy returns the differences between the snapshots like
+// DiffSnapshots, reporting retagged tags according to the conflict policy.
+func DiffSnapshotsWithPolicy(oldSnapshot, newSnapshot RepositorySnapshot, policy ConflictPolicy) SnapshotDiff {
+	oldImages := make(map[snapshotKey]*Image, len(oldSnapshot.Images))
+	for _, image := range oldSnapshot.Images {
+		oldImages[snapshotKey{image.Branch, image.Tag}] = image
+	}
+
+	var diff SnapshotDiff
+	branches := make(map[string]bool)
+	seen := make(map[snapshotKey]bool, len(newSnapshot.Images))
+	for _, image := range newSnapshot.Images {
+		key := snapshotKey{image.Branch, image.Tag}
+		seen[key] = true
+		oldImage, ok := oldImages[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, image)
+			branches[image.Branch] = true
+		case oldImage.Digest == "" || image.Digest == "" || oldImage.Digest == image.Digest:
+			diff.Unchanged = append(diff.Unchanged, image)
+		case policy == ConflictReport:
+			diff.Conflicts = append(diff.Conflicts, &ImageChange{Old: oldImage, New: image})
+			branches[image.Branch] = true
+		case policy == ConflictLatest && oldImage.LastModified.After(image.LastModified):
+			diff.Unchanged = append(diff.Unchanged, oldImage)
+		default:
+			diff.Changed = append(diff.Changed, &ImageChange{Old: oldImage, New: image})
+			branches[image.Branch] = true
+		}
+	}
+	for _, image := range oldSnapshot.Images {
+		if !seen[snapshotKey{image.Branch, image.Tag}] {
+			diff.Removed = append(diff.Removed, image)
+			branches[image.Branch] = true
+		}
+	}
+
+	for _, images := range [][]*Image{diff.Added, diff.Removed, diff.Unchanged} {
+		sortByBranchAndTag(images)
+	}
+	for _, changes := range [][]*ImageChange{diff.Changed, diff.Conflicts} {
+		sort.Slice(changes, func(i, j int) bool {
+			return imageLess(changes[i].New, changes[j].New)
+		})
+	}
+	for branch := range branches {
+		diff.Branches = append(diff.Branches, branch)
+	}
+	sort.Strings(diff.Branches)
+	return diff
+}
+
+// sortByBranchAndTag sorts images by branch and then tag
+func sortByBranchAndTag(images []*Image) {
+	sort.Sort(&imageSorter{images: images, by: imageLess})
+}
+
+// imageLess orders images by branch and then tag
+func imageLess(i1, i2 *Image) bool {
+	if i1.Branch != i2.Branch {
+		return i1.Branch < i2.Branch
+	}
+	return i1.Tag < i2.Tag
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepositorySnapshotJSON(t *testing.T) {
+	snapshot := &RepositorySnapshot{
+		Registry:   "quay.io",
+		Repository: "airware/vili",
+		Branches:   []string{"master"},
+		FetchedAt:  time.Unix(1500000000, 123456789),
+		Images: []*Image{
+			{
+				Registry:     "quay.io",
+				Tag:          "1500000000123-abcdef",
+				Branch:       "master",
+				Revision:     "abcdef",
+				LastModified: time.Unix(1500000000, 123000000),
+				Digest:       "sha256:abcdef",
+			},
+		},
+	}
+	data, err := json.Marshal(snapshot)
+	assert.NoError(t, err)
+
+	var decoded RepositorySnapshot
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, snapshot.Registry, decoded.Registry)
+	assert.Equal(t, snapshot.Repository, decoded.Repository)
+	assert.Equal(t, snapshot.Branches, decoded.Branches)
+	assert.True(t, snapshot.FetchedAt.Equal(decoded.FetchedAt))
+	assert.Len(t, decoded.Images, 1)
+	assert.True(t, snapshot.Images[0].LastModified.Equal(decoded.Images[0].LastModified))
+	decoded.Images[0].LastModified = snapshot.Images[0].LastModified
+	assert.Equal(t, snapshot.Images[0], decoded.Images[0])
+
+	assert.Error(t, json.Unmarshal([]byte(`{"version":2}`), &decoded))
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	oldSnapshot := RepositorySnapshot{Images: []*Image{
+		{Branch: "master", Tag: "1500000000-aaaaaa", Digest: testDigest("a")},
+		{Branch: "master", Tag: "latest", Digest: testDigest("a")},
+		{Branch: "develop", Tag: "1500000001-bbbbbb"},
+		{Branch: "develop", Tag: "1500000002-cccccc", Digest: testDigest("c")},
+	}}
+	newSnapshot := RepositorySnapshot{Images: []*Image{
+		{Branch: "master", Tag: "latest", Digest: testDigest("d")},
+		{Branch: "master", Tag: "1500000003-dddddd", Digest: testDigest("d")},
+		{Branch: "master", Tag: "1500000000-aaaaaa", Digest: testDigest("a")},
+		{Branch: "develop", Tag: "1500000001-bbbbbb", Digest: testDigest("b")},
+	}}
+
+	diff := DiffSnapshots(oldSnapshot, newSnapshot)
+	assert.Equal(t, []*Image{newSnapshot.Images[1]}, diff.Added)
+	assert.Equal(t, []*Image{oldSnapshot.Images[3]}, diff.Removed)
+	assert.Equal(t, []*ImageChange{{Old: oldSnapshot.Images[1], New: newSnapshot.Images[0]}}, diff.Changed)
+	// images without a digest in either snapshot are unchanged
+	assert.Equal(t, []*Image{newSnapshot.Images[3], newSnapshot.Images[2]}, diff.Unchanged)
+	assert.Equal(t, []string{"develop", "master"}, diff.Branches)
+}
+
+func TestDiffSnapshotsConflictPolicy(t *testing.T) {
+	oldSnapshot := RepositorySnapshot{Images: []*Image{
+		{Branch: "master", Tag: "latest", Digest: testDigest("a"), LastModified: time.Unix(1500000002, 0)},
+		{Branch: "master", Tag: "stable", Digest: testDigest("a"), LastModified: time.Unix(1500000000, 0)},
+	}}
+	newSnapshot := RepositorySnapshot{Images: []*Image{
+		{Branch: "master", Tag: "latest", Digest: testDigest("b"), LastModified: time.Unix(1500000001, 0)},
+		{Branch: "master", Tag: "stable", Digest: testDigest("b"), LastModified: time.Unix(1500000001, 0)},
+	}}
+
+	diff := DiffSnapshotsWithPolicy(oldSnapshot, newSnapshot, ConflictReport)
+	assert.Empty(t, diff.Changed)
+	assert.Equal(t, []*ImageChange{
+		{Old: oldSnapshot.Images[0], New: newSnapshot.Images[0]},
+		{Old: oldSnapshot.Images[1], New: newSnapshot.Images[1]},
+	}, diff.Conflicts)
+	assert.Equal(t, []string{"master"}, diff.Branches)
+
+	diff = DiffSnapshotsWithPolicy(oldSnapshot, newSnapshot, ConflictLatest)
+	assert.Empty(t, diff.Conflicts)
+	assert.Equal(t, []*ImageChange{{Old: oldSnapshot.Images[1], New: newSnapshot.Images[1]}}, diff.Changed)
+	assert.Equal(t, []*Image{oldSnapshot.Images[0]}, diff.Unchanged)
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/docker/distribution/registry/client"
+)
+
+// defaultStoragePageSize is the default number of tags processed per page of a storage report
+const defaultStoragePageSize = 100
+
+// StorageUsage is the storage used by the distinct blobs referenced by a repository's tags
+type StorageUsage struct {
+	// Tags is the number of tags processed
+	Tags int `json:"tags"`
+	// Blobs is the number of distinct blobs referenced by the processed tags
+	Blobs int `json:"blobs"`
+	// Bytes is the total size of the distinct blobs
+	Bytes int64 `json:"bytes"`
+}
+
+// RepoStorageUsage returns the storage used by the distinct blobs referenced by the
+// repository's tags, including the manifests of multi-platform images
+func (s *RegistryService) RepoStorageUsage(ctx context.Context, repo string) (*StorageUsage, error) {
+	return s.StreamRepoStorageUsage(ctx, repo, 0, nil)
+}
+
+// StreamRepoStorageUsage computes the repository's storage usage like RepoStorageUsage,
+// processing its tags in pages of pageSize (100 by default) and calling progress with
+// the running totals after each page. Blobs shared between pages are only counted once.
+// If ctx is cancelled, the requests of the current page are cancelled and the totals of
+// the finished pages are returned with the context's error.
+func (s *RegistryService) StreamRepoStorageUsage(ctx context.Context, repo string, pageSize int, progress func(StorageUsage)) (*StorageUsage, error) {
+	if pageSize <= 0 {
+		pageSize = defaultStoragePageSize
+	}
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return nil, err
+	}
+	transport = s.limitTransfer(&contextTransport{base: transport, ctx: ctx})
+	repository, err := client.NewRepository(ctx, repoNameRef, s.registryURL(), transport)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := repository.Tags(ctx).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Transport: transport}
+	lim := newLimiter(s.manifestConcurrency())
+	usage := &StorageUsage{}
+	seen := make(map[string]bool)
+
+	for start := 0; start < len(tags); start += pageSize {
+		if err := ctx.Err(); err != nil {
+			return usage, err
+		}
+		end := start + pageSize
+		if end > len(tags) {
+			end = len(tags)
+		}
+
+		var waitGroup sync.WaitGroup
+		var mutex sync.Mutex
+		var pageDescs []manifestDescriptor
+		errChan := make(chan error, end-start)
+		for _, tag := range tags[start:end] {
+			waitGroup.Add(1)
+			go func(tag string) {
+				defer waitGroup.Done()
+				lim.acquire()
+				defer lim.release()
+				descs, err := s.getManifestDescriptors(httpClient, repoNameRef, tag)
+				if err != nil {
+					errChan <- err
+					return
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				pageDescs = append(pageDescs, descs...)
+			}(tag)
+		}
+		waitGroup.Wait()
+		close(errChan)
+
+		// the totals only include finished pages, so that they match usage.Tags
+		if err := ctx.Err(); err != nil {
+			return usage, err
+		}
+		if err := <-errChan; err != nil {
+			return usage, err
+		}
+		for _, desc := range pageDescs {
+			if seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+			usage.Blobs++
+			usage.Bytes += desc.Size
+		}
+		usage.Tags = end
+		if progress != nil {
+			progress(*usage)
+		}
+	}
+	return usage, nil
+}
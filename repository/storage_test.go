@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryStreamRepoStorageUsage(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"a": testDigest("a"), "b": testDigest("b"), "c": testDigest("c")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"a": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+			"config": {"digest": "` + testDigest("c1") + `", "size": 1}, "layers": [{"digest": "` + testDigest("l1") + `", "size": 100}]}`,
+		"b": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+			"config": {"digest": "` + testDigest("c2") + `", "size": 2}, "layers": [{"digest": "` + testDigest("l1") + `", "size": 100}]}`,
+		"c": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+			"config": {"digest": "` + testDigest("c3") + `", "size": 3}, "layers": [{"digest": "` + testDigest("l1") + `", "size": 100}, {"digest": "` + testDigest("l2") + `", "size": 200}]}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	var pages []StorageUsage
+	usage, err := testService.StreamRepoStorageUsage(context.Background(), "vili", 2, func(usage StorageUsage) {
+		pages = append(pages, usage)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &StorageUsage{Tags: 3, Blobs: 5, Bytes: 306}, usage)
+	assert.Equal(t, []StorageUsage{{Tags: 2, Blobs: 3, Bytes: 103}, {Tags: 3, Blobs: 5, Bytes: 306}}, pages)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	usage, err = testService.StreamRepoStorageUsage(ctx, "vili", 2, func(StorageUsage) {
+		cancel()
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, usage.Tags)
+
+	// a page cancelled midway cancels its requests and isn't counted
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/manifests/c") {
+			cancel()
+			<-r.Context().Done()
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer hanging.Close()
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: hanging.URL}}
+	usage, err = testService.StreamRepoStorageUsage(ctx, "vili", 2, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, &StorageUsage{Tags: 2, Blobs: 3, Bytes: 103}, usage)
+}
+
+func TestRegistryMaxBytesPerOp(t *testing.T) {
+	reg, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"a": testDigest("a"), "b": testDigest("b")},
+	})
+	defer server.Close()
+	reg.manifests = map[string]string{
+		"a": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+			"config": {"digest": "` + testDigest("c1") + `", "size": 1}, "layers": [{"digest": "` + testDigest("l1") + `", "size": 100}]}`,
+		"b": `{"schemaVersion": 2, "mediaType": "` + MediaTypeSchema2 + `",
+			"config": {"digest": "` + testDigest("c2") + `", "size": 2}, "layers": [{"digest": "` + testDigest("l2") + `", "size": 100}]}`,
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, MaxBytesPerOp: 300}}
+	_, err := testService.RepoStorageUsage(context.Background(), "vili")
+	var limitErr *TransferLimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, int64(300), limitErr.Limit)
+
+	// the limit applies to each operation separately
+	testService.config.MaxBytesPerOp = 1000
+	for i := 0; i < 2; i++ {
+		usage, err := testService.RepoStorageUsage(context.Background(), "vili")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, usage.Tags)
+	}
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultArchSuffixes are the architecture suffixes recognized in tags by default
+var defaultArchSuffixes = []string{"amd64", "arm64", "arm", "386", "ppc64le", "s390x"}
+
+// gitRevisionPattern matches full and abbreviated git shas
+var gitRevisionPattern = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// TimestampUnit is the unit of the epoch timestamp in a tag
+type TimestampUnit string
+
+// Timestamp units
+const (
+	TimestampAuto         TimestampUnit = ""
+	TimestampSeconds      TimestampUnit = "s"
+	TimestampMilliseconds TimestampUnit = "ms"
+	TimestampMicroseconds TimestampUnit = "us"
+	TimestampNanoseconds  TimestampUnit = "ns"
+)
+
+// parsedTag holds the components parsed from a tag
+type parsedTag struct {
+	branch       string
+	revision     string
+	lastModified time.Time
+	arch         string
+}
+
+// parseTag parses a tag of the form <unixsecs>-<sha> into an image for the given branch,
+// or <branch>-<unixsecs>-<sha> if BranchPrefixTags is set. A trailing architecture
+// suffix, such as -amd64, is stripped into the image's Arch. It returns false if the
+// tag should be skipped.
+func (s *RegistryService) parseTag(tag, branchName string) (*Image, bool) {
+	parsed, ok := s.splitTag(tag)
+	if !ok || (s.config.BranchPrefixTags && parsed.branch != slugFromBranch(branchName)) {
+		return nil, false
+	}
+	if s.config.OnlyParseable && (parsed.lastModified.IsZero() || parsed.revision == "") {
+		return nil, false
+	}
+	return &Image{
+		Registry:      s.pullDomain(),
+		Tag:           tag,
+		Branch:        branchName,
+		Revision:      parsed.revision,
+		ShortRevision: s.shortRevision(parsed.revision),
+		LastModified:  parsed.lastModified,
+		Arch:          parsed.arch,
+	}, true
+}
+
+// shortRevision returns the lowercased revision abbreviated to ShortRevisionLength
+// characters, or "" if ShortRevisionLength is not set
+func (s *RegistryService) shortRevision(revision string) string {
+	if s.config.ShortRevisionLength <= 0 {
+		return ""
+	}
+	revision = strings.ToLower(revision)
+	if len(revision) > s.config.ShortRevisionLength {
+		return revision[:s.config.ShortRevisionLength]
+	}
+	return revision
+}
+
+// splitTag splits a tag into its components. It returns false if the tag does not
+// match the configured format.
+func (s *RegistryService) splitTag(tag string) (parsedTag, bool) {
+	var parsed parsedTag
+	if s.config.SortOrder == SortSemver && !s.config.BranchPrefixTags {
+		if _, ok := parseSemver(tag); ok {
+			return parsed, true
+		}
+	}
+	remainder := tag
+	if sepIndex := strings.LastIndex(remainder, "-"); sepIndex != -1 {
+		for _, arch := range s.archSuffixes() {
+			if remainder[sepIndex+1:] == arch && strings.Contains(remainder[:sepIndex], "-") {
+				parsed.arch = arch
+				remainder = remainder[:sepIndex]
+				break
+			}
+		}
+	}
+	if s.config.BranchPrefixTags {
+		shaIndex := strings.LastIndex(remainder, "-")
+		if shaIndex == -1 {
+			return parsed, false
+		}
+		dateIndex := strings.LastIndex(remainder[:shaIndex], "-")
+		if dateIndex == -1 {
+			return parsed, false
+		}
+		parsed.branch = remainder[:dateIndex]
+		remainder = remainder[dateIndex+1:]
+	}
+	sepIndex := strings.LastIndex(remainder, "-")
+	if sepIndex != -1 {
+		dateComponent, shaComponent := remainder[:sepIndex], remainder[sepIndex+1:]
+		lastModified, err := parseTimestamp(dateComponent, s.config.TimestampUnit)
+		if err != nil {
+			return parsed, false
+		}
+		parsed.revision = shaComponent
+		parsed.lastModified = lastModified
+	}
+	if s.config.RequireGitRevision && !gitRevisionPattern.MatchString(parsed.revision) {
+		return parsed, false
+	}
+	return parsed, true
+}
+
+// archSuffixes returns the architecture suffixes recognized at the end of tags
+func (s *RegistryService) archSuffixes() []string {
+	if s.config.ArchSuffixes != nil {
+		return s.config.ArchSuffixes
+	}
+	return defaultArchSuffixes
+}
+
+// parseTimestamp parses an epoch timestamp in the given unit. If the unit is
+// TimestampAuto, it is inferred from the number of digits: up to 11 digits are
+// seconds, up to 15 milliseconds, 16 microseconds and more nanoseconds.
+func parseTimestamp(component string, unit TimestampUnit) (time.Time, error) {
+	value, err := strconv.ParseInt(component, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if unit == TimestampAuto {
+		switch digits := len(component); {
+		case digits <= 11:
+			unit = TimestampSeconds
+		case digits <= 15:
+			unit = TimestampMilliseconds
+		case digits == 16:
+			unit = TimestampMicroseconds
+		default:
+			unit = TimestampNanoseconds
+		}
+	}
+	// the value is split into seconds so that large values can't overflow
+	switch unit {
+	case TimestampSeconds:
+		return time.Unix(value, 0), nil
+	case TimestampMilliseconds:
+		return time.Unix(value/1e3, (value%1e3)*1e6), nil
+	case TimestampMicroseconds:
+		return time.Unix(value/1e6, (value%1e6)*1e3), nil
+	case TimestampNanoseconds:
+		return time.Unix(0, value), nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp unit %q", unit)
+	}
+}
+
+// NextTag returns the tag of a build of the revision made now, in the
+// <timestamp>-<revision> format parsed by the service, with the timestamp in the
+// configured TimestampUnit, or seconds by default. Parsing the tag yields the
+// revision and the current time, truncated to the unit.
+func (s *RegistryService) NextTag(revision string) (string, error) {
+	if s.config.BranchPrefixTags {
+		return "", fmt.Errorf("branch-prefixed tags require a branch")
+	}
+	if revision == "" || strings.Contains(revision, "-") {
+		return "", fmt.Errorf("invalid revision %q", revision)
+	}
+	if s.config.RequireGitRevision && !gitRevisionPattern.MatchString(revision) {
+		return "", fmt.Errorf("revision %q is not a git revision", revision)
+	}
+	now := s.now()
+	var timestamp int64
+	switch s.config.TimestampUnit {
+	case TimestampAuto, TimestampSeconds:
+		timestamp = now.Unix()
+	case TimestampMilliseconds:
+		timestamp = now.UnixNano() / int64(time.Millisecond)
+	case TimestampMicroseconds:
+		timestamp = now.UnixNano() / int64(time.Microsecond)
+	case TimestampNanoseconds:
+		timestamp = now.UnixNano()
+	default:
+		return "", fmt.Errorf("invalid timestamp unit %q", s.config.TimestampUnit)
+	}
+	return fmt.Sprintf("%d-%s", timestamp, revision), nil
+}
+
+// now returns the current time of the configured Clock
+func (s *RegistryService) now() time.Time {
+	if s.config.Clock != nil {
+		return s.config.Clock()
+	}
+	return time.Now()
+}
+
+// DiscoverBranches returns the sorted branch slugs found in the repository's tags.
+// It requires BranchPrefixTags, since other tag formats do not record the branch.
+func (s *RegistryService) DiscoverBranches(repo string) ([]string, error) {
+	if !s.config.BranchPrefixTags {
+		return nil, fmt.Errorf("branch discovery requires branch-prefixed tags")
+	}
+	repository, err := s.getRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := listTags(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var branches []string
+	for _, tag := range tags {
+		parsed, ok := s.splitTag(tag)
+		if !ok || seen[parsed.branch] {
+			continue
+		}
+		seen[parsed.branch] = true
+		branches = append(branches, parsed.branch)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// GetRepositoryMatching returns the images for the branches discovered in the
+// repository's tags that match the given glob pattern, such as release-*. Branches
+// are matched by their tag slug, so feature/foo is matched as feature-foo.
+func (s *RegistryService) GetRepositoryMatching(repo, branchPattern string) ([]*Image, error) {
+	if _, err := path.Match(branchPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid branch pattern %q: %w", branchPattern, err)
+	}
+	branches, err := s.DiscoverBranches(repo)
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, branch := range branches {
+		if matched, _ := path.Match(branchPattern, branch); matched {
+			matching = append(matching, branch)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, nil
+	}
+	return s.GetRepository(repo, matching)
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airware/vili/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryParseTag(t *testing.T) {
+	for _, testCase := range []struct {
+		RegistryConfig
+		tag      string
+		branch   string
+		ok       bool
+		revision string
+		unixSecs int64
+	}{
+		{RegistryConfig{BaseURL: "https://quay.io"}, "1500000000-abcdef", "master", true, "abcdef", 1500000000},
+		{RegistryConfig{}, "latest", "master", true, "", 0},
+		{RegistryConfig{}, "master-1500000000-abcdef", "master", false, "", 0},
+		{RegistryConfig{BranchPrefixTags: true}, "master-1500000000-abcdef", "master", true, "abcdef", 1500000000},
+		{RegistryConfig{BranchPrefixTags: true}, "feature-cld-1-1500000000-abcdef", "feature/cld-1", true, "abcdef", 1500000000},
+		{RegistryConfig{BranchPrefixTags: true}, "develop-1500000000-abcdef", "master", false, "", 0},
+		{RegistryConfig{BranchPrefixTags: true}, "1500000000-abcdef", "master", false, "", 0},
+		{RegistryConfig{BranchPrefixTags: true}, "latest", "master", false, "", 0},
+		{RegistryConfig{}, "1500000000-abcdef-amd64", "master", true, "abcdef", 1500000000},
+		{RegistryConfig{}, "1500000000-abcdef-arm64", "master", true, "abcdef", 1500000000},
+		{RegistryConfig{}, "1500000000-amd64", "master", true, "amd64", 1500000000},
+		{RegistryConfig{ArchSuffixes: []string{}}, "1500000000-abcdef-amd64", "master", false, "", 0},
+		{RegistryConfig{BranchPrefixTags: true}, "master-1500000000-abcdef-arm", "master", true, "abcdef", 1500000000},
+	} {
+		testService := &RegistryService{config: &testCase.RegistryConfig}
+		image, ok := testService.parseTag(testCase.tag, testCase.branch)
+		assert.Equal(t, testCase.ok, ok, testCase.tag)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, testService.pullDomain(), image.Registry)
+		assert.Equal(t, testCase.tag, image.Tag)
+		assert.Equal(t, testCase.branch, image.Branch)
+		assert.Equal(t, testCase.revision, image.Revision)
+		if testCase.unixSecs != 0 {
+			assert.Equal(t, testCase.unixSecs, image.LastModified.Unix())
+		}
+	}
+}
+
+func TestRegistryParseTagRevision(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{RequireGitRevision: true, ShortRevisionLength: 7}}
+	for tag, shortRevision := range map[string]string{
+		"1500000000-0123456789ABCDEF0123456789abcdef01234567": "0123456",
+		"1500000000-abcdef1": "abcdef1",
+		"1500000000-abcdef":  "",
+		"1500000000-release": "",
+		"latest":             "",
+	} {
+		image, ok := testService.parseTag(tag, "master")
+		assert.Equal(t, shortRevision != "", ok, tag)
+		if ok {
+			assert.Equal(t, shortRevision, image.ShortRevision, tag)
+		}
+	}
+
+	testService.config.RequireGitRevision = false
+	image, ok := testService.parseTag("1500000000-abcdef", "master")
+	assert.True(t, ok)
+	assert.Equal(t, "abcdef", image.ShortRevision)
+	testService.config.ShortRevisionLength = 0
+	image, _ = testService.parseTag("1500000000-abcdef", "master")
+	assert.Equal(t, "", image.ShortRevision)
+}
+
+func TestRegistryOnlyParseable(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": testDigest("a"),
+			"latest":            testDigest("a"),
+			"stable-build":      testDigest("a"),
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	images, err := testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+
+	testService.config.OnlyParseable = true
+	images, err = testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "1500000000-abcdef", images[0].Tag)
+	}
+}
+
+func TestRegistryUnparseableWarnThreshold(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef": testDigest("a"),
+			"build42":                  testDigest("b"),
+			"build43":                  testDigest("c"),
+		},
+	})
+	defer server.Close()
+
+	var buf bytes.Buffer
+	logger := log.GetLogger()
+	out := logger.Out
+	logger.Out = &buf
+	defer func() { logger.Out = out }()
+
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL:                  server.URL,
+		BranchPrefixTags:         true,
+		UnparseableWarnThreshold: 0.5,
+	}}
+	result, err := testService.GetRepositoryDetailed("vili", []string{"master", "feature"})
+	assert.NoError(t, err)
+	assert.Len(t, result.Images, 1)
+	assert.Equal(t, 2, result.Branches["master"].Unparseable)
+	assert.Equal(t, 2, result.Branches["feature"].Unparseable)
+	assert.Equal(t, 1, strings.Count(buf.String(), "2 of 3 tags of vili do not match the tag format"))
+
+	buf.Reset()
+	testService.config.UnparseableWarnThreshold = 0.7
+	_, err = testService.GetRepository("vili", []string{"master"})
+	assert.NoError(t, err)
+	assert.Empty(t, buf.String())
+}
+
+func TestRegistryDuplicateTags(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {
+			"1500000000-abcdef": testDigest("a"),
+			"1500000100-bcdef0": testDigest("b"),
+		},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/vili/tags/list" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name": "vili",
+				"tags": []string{"1500000000-abcdef", "1500000100-bcdef0", "1500000000-abcdef"},
+			})
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	result, err := testService.GetRepositoryDetailed("vili", nil)
+	assert.NoError(t, err)
+	assert.Len(t, result.Images, 2)
+	assert.Equal(t, 1, result.Branches[""].Duplicates)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, testCase := range []struct {
+		component string
+		unit      TimestampUnit
+		expected  time.Time
+	}{
+		{"1500000000", TimestampAuto, time.Unix(1500000000, 0)},
+		{"1500000000123", TimestampAuto, time.Unix(1500000000, 123000000)},
+		{"1500000000123456789", TimestampAuto, time.Unix(1500000000, 123456789)},
+		{"99999999999", TimestampAuto, time.Unix(99999999999, 0)},
+		{"150000000012", TimestampAuto, time.Unix(150000000, 12000000)},
+		{"999999999999999", TimestampAuto, time.Unix(999999999999, 999000000)},
+		{"1500000000123456", TimestampAuto, time.Unix(1500000000, 123456000)},
+		{"15000000001234567", TimestampAuto, time.Unix(15000000, 1234567)},
+		{"1500000000123456", TimestampMicroseconds, time.Unix(1500000000, 123456000)},
+		{"1500000000123", TimestampSeconds, time.Unix(1500000000123, 0)},
+		{"1500000000", TimestampMilliseconds, time.Unix(1500000, 0)},
+		{"1500000000", TimestampNanoseconds, time.Unix(1, 500000000)},
+	} {
+		lastModified, err := parseTimestamp(testCase.component, testCase.unit)
+		assert.NoError(t, err)
+		assert.True(t, testCase.expected.Equal(lastModified), testCase.component)
+	}
+
+	_, err := parseTimestamp("abc", TimestampAuto)
+	assert.Error(t, err)
+	_, err = parseTimestamp("1500000000", "weeks")
+	assert.Error(t, err)
+}
+
+func TestRegistryParseTagArch(t *testing.T) {
+	testService := &RegistryService{config: &RegistryConfig{}}
+	for tag, arch := range map[string]string{
+		"1500000000-abcdef-amd64": "amd64",
+		"1500000000-abcdef-arm":   "arm",
+		"1500000000-abcdef":       "",
+		"1500000000-amd64":        "",
+	} {
+		image, ok := testService.parseTag(tag, "master")
+		assert.True(t, ok, tag)
+		assert.Equal(t, arch, image.Arch, tag)
+	}
+}
+
+func TestRegistryGetRepositoryMatching(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {
+			"master-1500000000-abcdef":    "sha256:a",
+			"release-1-1500000100-bcdef0": "sha256:b",
+			"release-2-1500000200-cdef01": "sha256:c",
+			"latest":                      "sha256:c",
+		},
+	})
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, BranchPrefixTags: true}}
+	branches, err := testService.DiscoverBranches("vili")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"master", "release-1", "release-2"}, branches)
+
+	images, err := testService.GetRepositoryMatching("vili", "release-*")
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "release-2", images[0].Branch)
+	assert.Equal(t, "release-1", images[1].Branch)
+
+	_, err = testService.GetRepositoryMatching("vili", "release-[")
+	assert.Error(t, err)
+
+	testService.config.BranchPrefixTags = false
+	_, err = testService.DiscoverBranches("vili")
+	assert.Error(t, err)
+}
+
+func TestRegistryNextTag(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+	for unit, precision := range map[TimestampUnit]time.Duration{
+		TimestampAuto:         time.Second,
+		TimestampSeconds:      time.Second,
+		TimestampMilliseconds: time.Millisecond,
+		TimestampNanoseconds:  time.Nanosecond,
+	} {
+		testService := &RegistryService{config: &RegistryConfig{
+			TimestampUnit:      unit,
+			RequireGitRevision: true,
+			Clock:              func() time.Time { return now },
+		}}
+		tag, err := testService.NextTag("abcdef0")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		image, ok := testService.parseTag(tag, "")
+		if assert.True(t, ok, tag) {
+			assert.Equal(t, "abcdef0", image.Revision)
+			assert.True(t, now.Truncate(precision).Equal(image.LastModified), tag)
+		}
+	}
+
+	testService := &RegistryService{config: &RegistryConfig{Clock: func() time.Time { return now }}}
+	tag, err := testService.NextTag("abcdef0")
+	assert.NoError(t, err)
+	assert.Equal(t, "1500000000-abcdef0", tag)
+	_, err = testService.NextTag("abc-def")
+	assert.Error(t, err)
+
+	testService.config.BranchPrefixTags = true
+	_, err = testService.NextTag("abcdef0")
+	assert.Error(t, err)
+}
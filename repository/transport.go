@@ -0,0 +1,326 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/docker/distribution/registry/client/transport"
+)
+
+// RequestInterceptor is invoked on every outbound registry request before it is sent.
+// It may modify the request, for example to add signature or correlation headers.
+type RequestInterceptor func(*http.Request) error
+
+// DialContextFunc dials a network connection, as in net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// getHTTPTransport returns the HTTP transport underlying all registry requests,
+// using the configured dialer, client certificate and idle timeout if there are any.
+// The transport is a copy of the default transport owned by the service, so that
+// closing its idle connections doesn't affect other clients.
+func (s *RegistryService) getHTTPTransport() http.RoundTripper {
+	s.httpTransportOnce.Do(func() {
+		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+		if s.config.DialContext != nil {
+			httpTransport.DialContext = s.config.DialContext
+		}
+		if s.config.IdleConnTimeout > 0 {
+			httpTransport.IdleConnTimeout = s.config.IdleConnTimeout
+		}
+		if s.config.ClientCert != "" {
+			cert, err := tls.LoadX509KeyPair(s.config.ClientCert, s.config.ClientKey)
+			if err != nil {
+				s.httpTransport = &errorTransport{err: fmt.Errorf("failed to load registry client certificate: %w", err)}
+				return
+			}
+			httpTransport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		s.httpTransport = httpTransport
+	})
+	return s.httpTransport
+}
+
+// resetRetryTransport is an http.RoundTripper that retries GET and HEAD requests once
+// when their connection is reset, as when a load balancer drops a keep-alive
+// connection that sat idle. Idle connections are closed before retrying, since they
+// were likely dropped too, so the retry is made on a fresh connection.
+type resetRetryTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *resetRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil || !errors.Is(err, syscall.ECONNRESET) || req.Context().Err() != nil ||
+		(req.Method != "GET" && req.Method != "HEAD") {
+		return resp, err
+	}
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	return t.base.RoundTrip(req)
+}
+
+// errorTransport is an http.RoundTripper that fails every request with an error
+type errorTransport struct {
+	err error
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+// interceptorTransport is an http.RoundTripper that runs a RequestInterceptor
+// on a copy of each request before handing it to the base transport
+type interceptorTransport struct {
+	base        http.RoundTripper
+	interceptor RequestInterceptor
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *interceptorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if err := t.interceptor(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// hostScopedModifier applies a request modifier only to requests sent to the
+// registry host, so that registry credentials are not attached when a request
+// is redirected to another host, such as a presigned blob storage URL
+type hostScopedModifier struct {
+	host     string
+	modifier transport.RequestModifier
+}
+
+// ModifyRequest implements the transport.RequestModifier interface
+func (m *hostScopedModifier) ModifyRequest(req *http.Request) error {
+	if req.URL.Host != m.host {
+		return nil
+	}
+	return m.modifier.ModifyRequest(req)
+}
+
+// rateLimitTransport is an http.RoundTripper that turns 429 Too Many Requests
+// responses into a *RateLimitedError
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, &RateLimitedError{
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// transferLimitTransport is an http.RoundTripper that counts the response bytes read
+// across all of its requests, failing reads with a *TransferLimitError once the limit
+// is exceeded
+type transferLimitTransport struct {
+	base  http.RoundTripper
+	limit int64
+	read  int64
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *transferLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt64(&t.read) > t.limit {
+		return nil, &TransferLimitError{Limit: t.limit}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingReadCloser{ReadCloser: resp.Body, transport: t}
+	return resp, nil
+}
+
+// countingReadCloser counts the bytes read from a response body against its transport's limit
+type countingReadCloser struct {
+	io.ReadCloser
+	transport *transferLimitTransport
+}
+
+// Read implements the io.Reader interface
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if atomic.AddInt64(&r.transport.read, int64(n)) > r.transport.limit {
+		return n, &TransferLimitError{Limit: r.transport.limit}
+	}
+	return n, err
+}
+
+// limitTransfer returns a transport for a single operation that enforces MaxBytesPerOp
+// across all of the operation's requests, or the given transport if there is no limit
+func (s *RegistryService) limitTransfer(transport http.RoundTripper) http.RoundTripper {
+	if s.config.MaxBytesPerOp <= 0 {
+		return transport
+	}
+	return &transferLimitTransport{base: transport, limit: s.config.MaxBytesPerOp}
+}
+
+// reauthTransport is an http.RoundTripper that renews its authorized transport when a
+// request is rejected with 401 Unauthorized, as when a token expires mid-operation, and
+// retries the request once with the renewed transport
+type reauthTransport struct {
+	authorize func() http.RoundTripper
+
+	mutex   sync.Mutex
+	current http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	current := t.current
+	t.mutex.Unlock()
+
+	resp, err := current.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	retryReq := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+
+	// only the first of the requests rejected by the same transport renews it
+	t.mutex.Lock()
+	if t.current == current {
+		t.current = t.authorize()
+	}
+	renewed := t.current
+	t.mutex.Unlock()
+	return renewed.RoundTrip(retryReq)
+}
+
+// defaultTagListCacheSize is the number of tag list responses cached for
+// ConditionalTagLists by default
+const defaultTagListCacheSize = 1000
+
+// tagListResponse is a cached tag list response
+type tagListResponse struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// conditionalTagListTransport is an http.RoundTripper that sends If-None-Match with
+// the ETag of the last response to each tag list request, answering 304 Not Modified
+// responses with the cached response
+type conditionalTagListTransport struct {
+	base      http.RoundTripper
+	responses *lruCache
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *conditionalTagListTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || !strings.HasSuffix(req.URL.Path, "/tags/list") {
+		return t.base.RoundTrip(req)
+	}
+	key := req.URL.String()
+	var cached *tagListResponse
+	if response, ok := t.responses.get(key); ok {
+		cached = response.(*tagListResponse)
+	}
+	if cached != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		resp.Body.Close()
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        cached.header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       resp.Request,
+		}, nil
+	case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.responses.add(key, &tagListResponse{
+			etag:   resp.Header.Get("ETag"),
+			header: resp.Header.Clone(),
+			body:   body,
+		})
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+	return resp, nil
+}
+
+// conditionalTagLists wraps the transport to cache tag list responses in the cache
+// shared by all of the service's transports
+func (s *RegistryService) conditionalTagLists(base http.RoundTripper) http.RoundTripper {
+	s.tagListsOnce.Do(func() {
+		size := s.config.TagListCacheSize
+		if size <= 0 {
+			size = defaultTagListCacheSize
+		}
+		s.tagLists = newLRUCache(size)
+	})
+	return &conditionalTagListTransport{base: base, responses: s.tagLists}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryDialContext(t *testing.T) {
+	_, server := newTestRegistry(map[string]map[string]string{
+		"vili": {"master": "sha256:f0a2bd2fd3e61e2b1ca6ba6ddba4a9bb7b9a47d4e6d0c2e0a9ac28d7a2a1e54c"},
+	})
+	defer server.Close()
+
+	var dialed []string
+	testService := &RegistryService{config: &RegistryConfig{
+		BaseURL: "http://registry.test",
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return new(net.Dialer).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+	_, err := testService.GetTag("vili", "master")
+	assert.NoError(t, err)
+	assert.Contains(t, dialed, "registry.test:80")
+}
+
+func TestRegistryClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vili-client-cert")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vili"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	assert.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	testService := &RegistryService{config: &RegistryConfig{ClientCert: certPath, ClientKey: keyPath}}
+	httpTransport, ok := testService.getHTTPTransport().(*http.Transport)
+	if assert.True(t, ok) {
+		assert.Len(t, httpTransport.TLSClientConfig.Certificates, 1)
+		assert.Equal(t, certDER, httpTransport.TLSClientConfig.Certificates[0].Certificate[0])
+	}
+
+	testService = &RegistryService{config: &RegistryConfig{
+		BaseURL:    "https://registry.test",
+		ClientCert: filepath.Join(dir, "missing.crt"),
+		ClientKey:  keyPath,
+	}}
+	_, err = testService.GetTag("vili", "master")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to load registry client certificate")
+}
+
+func TestRegistryConditionalTagLists(t *testing.T) {
+	var fullResponses, notModified int
+	tags := `{"name":"vili","tags":["master-1500000100-bcdef0"]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+			return
+		}
+		etag := `"` + digest.FromBytes([]byte(tags)).String() + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses++
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(tags))
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ConditionalTagLists: true}}
+	for i := 0; i < 2; i++ {
+		listed, err := testService.ListTags(context.Background(), "vili", 0, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"master-1500000100-bcdef0"}, listed)
+	}
+	assert.Equal(t, 1, fullResponses)
+	assert.Equal(t, 1, notModified)
+
+	tags = `{"name":"vili","tags":["master-1500000100-bcdef0","master-1500000200-cdef01"]}`
+	listed, err := testService.ListTags(context.Background(), "vili", 0, nil)
+	assert.NoError(t, err)
+	assert.Len(t, listed, 2)
+	assert.Equal(t, 2, fullResponses)
+
+	// once evicted, a tag list is fetched in full again
+	testService = &RegistryService{config: &RegistryConfig{BaseURL: server.URL, ConditionalTagLists: true, TagListCacheSize: 1}}
+	for _, repo := range []string{"vili", "redis", "vili"} {
+		_, err := testService.ListTags(context.Background(), repo, 0, nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 5, fullResponses)
+}
+
+func TestRegistryRetryOnConnectionReset(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL, IdleConnTimeout: 30 * time.Second}}
+	httpClient := &http.Client{Transport: testService.baseTransport()}
+	resp, err := httpClient.Get(server.URL + "/v2/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, 30*time.Second, testService.getHTTPTransport().(*http.Transport).IdleConnTimeout)
+
+	// requests that may not be idempotent are not retried
+	atomic.StoreInt32(&requests, 0)
+	_, err = httpClient.Post(server.URL+"/v2/", "application/json", strings.NewReader("{}"))
+	assert.Error(t, err)
+
+	// the idle connections closed on reset are the service's own
+	defaultService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	assert.True(t, defaultService.getHTTPTransport() != http.DefaultTransport)
+}
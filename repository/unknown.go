@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+)
+
+// unknownError maps the registry's NAME_UNKNOWN and MANIFEST_UNKNOWN error responses
+// to errors wrapping ErrRepositoryUnknown and ErrTagUnknown, returning other errors as is
+func unknownError(err error) error {
+	var errs errcode.Errors
+	switch e := err.(type) {
+	case errcode.Errors:
+		errs = e
+	case errcode.ErrorCode, errcode.Error:
+		errs = errcode.Errors{e}
+	default:
+		return err
+	}
+	for _, e := range errs {
+		coder, ok := e.(errcode.ErrorCoder)
+		if !ok {
+			continue
+		}
+		switch coder.ErrorCode() {
+		case v2.ErrorCodeNameUnknown:
+			return fmt.Errorf("%w: %v", ErrRepositoryUnknown, err)
+		case v2.ErrorCodeManifestUnknown:
+			return fmt.Errorf("%w: %v", ErrTagUnknown, err)
+		}
+	}
+	return err
+}
+
+// isNotFoundResponse returns whether the error is a 404 Not Found response without an
+// error body, as returned for HEAD requests
+func isNotFoundResponse(err error) bool {
+	respErr, ok := err.(*client.UnexpectedHTTPResponseError)
+	return ok && respErr.StatusCode == http.StatusNotFound
+}
+
+// knownRepositoriesSize is the number of repositories remembered to exist
+const knownRepositoriesSize = 1000
+
+// markRepositoryKnown remembers that the repository exists, so that manifests missing
+// from it can be told from an unknown repository without asking the registry
+func (s *RegistryService) markRepositoryKnown(repo string) {
+	s.knownRepositoryCache().add(repo, true)
+}
+
+// isRepositoryKnown returns whether the repository was seen to exist
+func (s *RegistryService) isRepositoryKnown(repo string) bool {
+	_, ok := s.knownRepositoryCache().get(repo)
+	return ok
+}
+
+// knownRepositoryCache returns the cache of repositories seen to exist
+func (s *RegistryService) knownRepositoryCache() *lruCache {
+	s.knownRepositoriesOnce.Do(func() {
+		s.knownRepositories = newLRUCache(knownRepositoriesSize)
+	})
+	return s.knownRepositories
+}
+
+// manifestUnknownError maps the error of a manifest request like unknownError, using
+// the error code of the registry's response if it has one. HEAD responses carry no
+// error body, so if the manifest was not found in a repository not yet seen to exist,
+// the request is repeated with GET. If the error cannot be classified, err is returned.
+func (s *RegistryService) manifestUnknownError(repo, ref string, err error) error {
+	return s.manifestUnknownErrorContext(context.Background(), repo, ref, err)
+}
+
+// manifestUnknownErrorContext maps the error of a manifest request like
+// manifestUnknownError, cancelling the GET request when the context is done
+func (s *RegistryService) manifestUnknownErrorContext(ctx context.Context, repo, ref string, err error) error {
+	if !isNotFoundResponse(err) {
+		if _, ok := err.(*NotFoundError); !ok {
+			unknownErr := unknownError(err)
+			if errors.Is(unknownErr, ErrTagUnknown) {
+				s.markRepositoryKnown(repo)
+			}
+			return unknownErr
+		}
+	}
+	if s.isRepositoryKnown(repo) {
+		return fmt.Errorf("%w: %v", ErrTagUnknown, err)
+	}
+	repoNameRef, transport, reqErr := s.getRepositoryTransport(repo)
+	if reqErr != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: &contextTransport{base: transport, ctx: ctx}}
+	req, reqErr := http.NewRequest("GET", s.registryURL()+"/v2/"+repoNameRef.Name()+"/manifests/"+ref, nil)
+	if reqErr != nil {
+		return err
+	}
+	for _, mediaType := range s.acceptedMediaTypes() {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, reqErr := httpClient.Do(req)
+	if reqErr != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		return err
+	}
+	unknownErr := unknownError(client.HandleErrorResponse(resp))
+	if errors.Is(unknownErr, ErrTagUnknown) {
+		s.markRepositoryKnown(repo)
+	}
+	if errors.Is(unknownErr, ErrRepositoryUnknown) || errors.Is(unknownErr, ErrTagUnknown) {
+		return unknownErr
+	}
+	return err
+}
+
+// isNotFound returns whether the error is a manifest or repository that was not found
+func isNotFound(err error) bool {
+	if _, ok := err.(*NotFoundError); ok {
+		return true
+	}
+	return errors.Is(err, ErrRepositoryUnknown) || errors.Is(err, ErrTagUnknown) || isNotFoundResponse(err)
+}
+
+// primary returns the service for the PrimaryURL registry, configured like the replica
+func (s *RegistryService) primary() *RegistryService {
+	s.primaryOnce.Do(func() {
+		config := *s.config
+		config.BaseURL = s.config.PrimaryURL
+		config.PrimaryURL = ""
+		s.primaryService = NewRegistry(&config)
+	})
+	return s.primaryService
+}
+
+// listTags lists all of the repository's tags, mapping an unknown repository to
+// ErrRepositoryUnknown
+func listTags(repository distribution.Repository) ([]string, error) {
+	tags, err := repository.Tags(context.Background()).All(context.Background())
+	if err != nil {
+		return nil, unknownError(err)
+	}
+	return tags, nil
+}
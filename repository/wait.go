@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ExistsContext returns whether the tag exists like Exists, cancelling the requests
+// when the context is done.
+func (s *RegistryService) ExistsContext(ctx context.Context, repo, tag string) (bool, error) {
+	repoNameRef, transport, err := s.getRepositoryTransport(repo)
+	if err != nil {
+		return false, err
+	}
+	httpClient := &http.Client{Transport: &contextTransport{base: transport, ctx: ctx}}
+	_, err = s.headManifest(httpClient, repoNameRef, tag)
+	switch err.(type) {
+	case nil:
+		s.markRepositoryKnown(repo)
+		return true, nil
+	case *NotFoundError:
+	default:
+		return false, unknownError(err)
+	}
+
+	unknownErr := s.manifestUnknownErrorContext(ctx, repo, tag, err)
+	if errors.Is(unknownErr, ErrRepositoryUnknown) {
+		return false, unknownErr
+	}
+	if s.config.PrimaryURL != "" && errors.Is(unknownErr, ErrTagUnknown) {
+		return s.primary().ExistsContext(ctx, repo, tag)
+	}
+	return false, nil
+}
+
+// maxWaitBackoff caps the delay between polls of WaitForTag after transient failures,
+// unless the poll interval is longer
+const maxWaitBackoff = 30 * time.Second
+
+// WaitForTag polls ExistsContext at the given interval until the tag appears in the
+// repository, or until the context is done, returning the context's error. A
+// repository that is not known to the registry yet is polled like a missing tag.
+// Transient errors back off exponentially from the interval, and other errors are
+// returned immediately. The polls are scheduled by system timers, not the Clock.
+func (s *RegistryService) WaitForTag(ctx context.Context, repo, tag string, interval time.Duration) error {
+	maxBackoff := maxWaitBackoff
+	if interval > maxBackoff {
+		maxBackoff = interval
+	}
+	backoff := &ExponentialBackoff{Initial: interval, Max: maxBackoff}
+	failures := 0
+	for {
+		exists, err := s.ExistsContext(ctx, repo, tag)
+		switch {
+		case exists:
+			return nil
+		case err == nil || errors.Is(err, ErrRepositoryUnknown):
+			failures = 0
+		case isTransient(err):
+			failures++
+		default:
+			return err
+		}
+
+		delay := interval
+		if failures > 0 {
+			delay = backoff.ceiling(failures)
+		}
+		if err := s.wait(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for the delay to pass, returning the context's error if it is done first
+func (s *RegistryService) wait(ctx context.Context, delay time.Duration) error {
+	if s.after != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.after(delay):
+			return nil
+		}
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWaitForTag(t *testing.T) {
+	reg := &testRegistry{tags: map[string]map[string]string{
+		"vili": {"1500000000-abcdef": testDigest("a")},
+	}}
+	var polls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" && strings.HasSuffix(r.URL.Path, "/manifests/pending") {
+			switch atomic.AddInt32(&polls, 1) {
+			case 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case 2:
+			default:
+				r.URL.Path = strings.TrimSuffix(r.URL.Path, "pending") + "1500000000-abcdef"
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var delays []time.Duration
+	testService := &RegistryService{
+		config: &RegistryConfig{BaseURL: server.URL},
+		after: func(delay time.Duration) <-chan time.Time {
+			delays = append(delays, delay)
+			c := make(chan time.Time, 1)
+			c <- time.Time{}
+			return c
+		},
+	}
+	assert.NoError(t, testService.WaitForTag(context.Background(), "vili", "pending", 10*time.Second))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&polls))
+	assert.Equal(t, []time.Duration{20 * time.Second, 10 * time.Second}, delays)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	testService.after = func(delay time.Duration) <-chan time.Time {
+		cancel()
+		return make(chan time.Time)
+	}
+	err := testService.WaitForTag(ctx, "vili", "missing", time.Minute)
+	assert.Equal(t, context.Canceled, err)
+
+	testService.after = nil
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = testService.WaitForTag(ctx, "vili", "missing", 10*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	reg.basicAuth = "Basic secret"
+	err = testService.WaitForTag(context.Background(), "vili", "missing", 10*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestRegistryWaitForTagHangingRequest(t *testing.T) {
+	reg := &testRegistry{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			<-r.Context().Done()
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	testService := &RegistryService{config: &RegistryConfig{BaseURL: server.URL}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- testService.WaitForTag(ctx, "vili", "pending", time.Minute)
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForTag ignored the context while a request hung")
+	}
+}